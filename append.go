@@ -0,0 +1,159 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// countingReader counts the bytes read from an underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// NewAppendWriter creates a Writer that appends to the existing uncompressed tarmac archive in f using the given
+// options. The archive is read in full in order to rebuild the mapping of the backing store under rootArchivePath, so
+// that contents that are already present in that store are not stored again, and f is left positioned at the end of
+// its last entry, where the new entries are written when the tree is added. Closing the Writer writes a new tar
+// footer.
+//
+// If options.Hash is empty, the hash algorithm and length recorded in the existing backing store are used. It is an
+// error to request a different algorithm or length. The statistics reported by the Writer include the existing
+// contents of the archive.
+func NewAppendWriter(f io.ReadWriteSeeker, rootArchivePath string, options Options) (*Writer, error) {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, magicSize)
+	n, _ := io.ReadFull(f, magic)
+	if compressionOf(magic[:n]) != "" {
+		return nil, errors.New("cannot append to a compressed archive")
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	// tar.Reader reads exactly the headers and contents of each entry, so the count of bytes read after each entry's
+	// contents, rounded up to the block size, is the offset of the end of that entry.
+	input := &countingReader{r: f}
+
+	// The offsets of the existing entries are unknown, so the archive cannot be indexed.
+	options.Index = false
+	w := NewWriterOptions(f, rootArchivePath, options)
+
+	// The global header, if any, is already at the start of the archive.
+	w.wroteGlobalHeader = true
+
+	// The existing entries are recorded so that new entries are not archived at their paths (see checkDuplicate).
+	var end int64
+	hasStore, err := w.readStore(input, func(header *tar.Header) {
+		if header.Typeflag != tar.TypeXGlobalHeader {
+			w.names[path.Clean(header.Name)] = archivedEntry{dir: header.Typeflag == tar.TypeDir}
+		}
+		if header.Typeflag == tar.TypeDir {
+			w.dirs[path.Clean(header.Name)] = true
+		}
+		end = (input.n + blockSize - 1) / blockSize * blockSize
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// New backing files are added to the existing store, which already describes its algorithm.
+	w.wroteAlgorithm = hasStore
+
+	_, err = f.Seek(end, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// readStore reads the tarmac archive in r and records the backing files in the Writer's backing store in its mapping,
+// along with the number of links to each. If options.Hash is empty, the hash algorithm and length recorded in the store
+// are adopted; otherwise they must match. If after is non-nil, it is called for each entry once its contents have been
+// read. readStore returns true if the archive contains the Writer's backing store.
+func (w *Writer) readStore(r io.Reader, after func(header *tar.Header)) (bool, error) {
+	store := w.storePath()
+	sawAlgorithm := false
+
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+
+		name := path.Clean(header.Name)
+		switch {
+		case header.Typeflag == tar.TypeReg && name == path.Join(store, algorithmFileName):
+			contents, err := io.ReadAll(archive)
+			if err != nil {
+				return false, err
+			}
+
+			algorithm, bytes, err := parseAlgorithm(string(contents))
+			if err != nil {
+				return false, err
+			}
+
+			if w.options.Hash == "" {
+				w.options.Hash = algorithm
+				if w.options.HashBytes == 0 {
+					w.options.HashBytes = bytes
+				}
+			}
+
+			recorded, requested := formatAlgorithm(algorithm, bytes), formatAlgorithm(w.options.Hash, w.options.HashBytes)
+			if recorded != requested {
+				return false, fmt.Errorf("archive uses hash algorithm %q, not %q", strings.TrimSpace(recorded), strings.TrimSpace(requested))
+			}
+			sawAlgorithm = true
+		case header.Typeflag == tar.TypeReg && name == path.Join(store, indexFileName):
+			// The index of an indexed archive is not a backing file.
+		case header.Typeflag == tar.TypeReg && path.Dir(name) == store:
+			w.mapping[path.Base(name)] = &backingFile{size: contentSize(header)}
+		case header.Typeflag == tar.TypeLink && path.Dir(path.Clean(header.Linkname)) == store:
+			if backing, ok := w.mapping[path.Base(path.Clean(header.Linkname))]; ok {
+				backing.refs++
+			}
+		}
+
+		_, err = io.Copy(io.Discard, archive)
+		if err != nil {
+			return false, err
+		}
+		if after != nil {
+			after(header)
+		}
+	}
+
+	// Archives written before the algorithm was recorded use the default.
+	if len(w.mapping) != 0 && !sawAlgorithm {
+		if w.options.Hash != "" && w.options.Hash != DefaultHash || w.options.HashBytes != 0 {
+			return false, fmt.Errorf("archive uses hash algorithm %q, not %q", DefaultHash, w.options.Hash)
+		}
+	}
+
+	return sawAlgorithm || len(w.mapping) != 0, nil
+}
+
+// blockSize is the size of a tar block.
+const blockSize = 512
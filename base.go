@@ -0,0 +1,36 @@
+package tarmac
+
+import (
+	"fmt"
+	"io"
+)
+
+// AddBase reads the tarmac archive in r, the base of the archive that is being written, and records the backing files
+// in its backing store under the Writer's root path. Files whose contents are already stored in the base are then
+// written as links to the base's backing files rather than being stored again, which makes the new archive a delta
+// that only contains the contents that are new since the base. A delta can only be extracted along with its base (see
+// ExtractAll). Compressed archives are detected and decompressed transparently.
+//
+// AddBase must be called before any trees are added. If options.Hash is empty, the algorithm recorded in the base's
+// backing store is used; otherwise it must match. The statistics reported by the Writer count references to files in
+// the base as deduplicated.
+func (w *Writer) AddBase(r io.Reader) error {
+	input, err := openArchive(r)
+	if err != nil {
+		return err
+	}
+
+	hasStore, err := w.readStore(input, nil)
+	if err != nil {
+		return err
+	}
+	if !hasStore {
+		return fmt.Errorf("the base archive has no backing store at %s", w.storePath())
+	}
+
+	// Only the references that this archive makes count towards its statistics.
+	for _, backing := range w.mapping {
+		backing.base, backing.refs = true, 0
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package tarmac
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/fstest"
+)
+
+// benchmarkFS returns a file system that holds count files of the given size with distinct contents, and their total
+// size.
+func benchmarkFS(count, size int) (fstest.MapFS, int64) {
+	rng := rand.New(rand.NewSource(1))
+	fsys := make(fstest.MapFS)
+	for i := 0; i < count; i++ {
+		data := make([]byte, size)
+		rng.Read(data)
+		fsys[fmt.Sprintf("d%d/f%d", i%16, i)] = &fstest.MapFile{Data: data, Mode: 0644}
+	}
+	return fsys, int64(count) * int64(size)
+}
+
+// benchmarkAddFS archives fsys with each of a range of Jobs.
+func benchmarkAddFS(b *testing.B, fsys fstest.MapFS, total int64) {
+	for _, jobs := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			b.SetBytes(total)
+			for i := 0; i < b.N; i++ {
+				w := NewWriterOptions(io.Discard, "root", Options{Jobs: jobs})
+				if err := w.AddFS(fsys); err != nil {
+					b.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkManySmallFiles(b *testing.B) {
+	fsys, total := benchmarkFS(4096, 1<<10)
+	benchmarkAddFS(b, fsys, total)
+}
+
+func BenchmarkFewLargeFiles(b *testing.B) {
+	fsys, total := benchmarkFS(4, 16<<20)
+	benchmarkAddFS(b, fsys, total)
+}
+
+// BenchmarkMmap compares hashing and writing large host files through a buffer with mapping them into memory (see
+// Options.MmapThreshold), which only applies to files read from the host's file system.
+func BenchmarkMmap(b *testing.B) {
+	fsys, total := benchmarkFS(4, 16<<20)
+	files := make(map[string]string, len(fsys))
+	for name, file := range fsys {
+		files[name] = string(file.Data)
+	}
+	dir := writeTree(b, files)
+
+	for _, mode := range []struct {
+		name      string
+		threshold int64
+	}{{"stream", 0}, {"mmap", 1}} {
+		b.Run(mode.name, func(b *testing.B) {
+			b.SetBytes(total)
+			for i := 0; i < b.N; i++ {
+				w := NewWriterOptions(io.Discard, "root", Options{MmapThreshold: mode.threshold, BufferThreshold: -1})
+				if err := w.AddTree(dir); err != nil {
+					b.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+)
+
+// Cat writes the contents of the regular file at archivePath in the tarmac archive in r to w. Compressed archives are
+// detected and decompressed transparently.
+//
+// Backing files precede the link entries that refer to them, so the archive is read a second time to find the
+// contents of a file that is stored as a link. This requires that r be seekable.
+func Cat(r io.ReadSeeker, archivePath string, w io.Writer) error {
+	archivePath = path.Clean(archivePath)
+
+	header, archive, err := findEntry(r, archivePath)
+	if err != nil {
+		return err
+	}
+
+	switch header.Typeflag {
+	case tar.TypeReg:
+		if isChunked(header) {
+			err = catChunks(r, header, archive, w)
+			if err != nil {
+				return fmt.Errorf("%s: %v", archivePath, err)
+			}
+			return nil
+		}
+		return copyContents(w, header, archive)
+	case tar.TypeLink:
+		// Fall through to find the target of the link.
+	default:
+		return fmt.Errorf("%s: not a regular file", archivePath)
+	}
+
+	linkname := path.Clean(header.Linkname)
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("%s: cannot reread the archive to find its contents: %v", archivePath, err)
+	}
+
+	target, archive, err := findEntry(r, linkname)
+	if err != nil {
+		return err
+	}
+	if target.Typeflag != tar.TypeReg {
+		return fmt.Errorf("%s: link target %s is not a regular file", archivePath, linkname)
+	}
+
+	return copyContents(w, target, archive)
+}
+
+// copyContents copies the contents of the regular file entry with the given header from archive to w.
+func copyContents(w io.Writer, header *tar.Header, archive *tar.Reader) error {
+	r, err := contents(header, archive)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// findEntry returns the first entry at archivePath in the archive in r, along with a reader positioned at its
+// contents.
+func findEntry(r io.Reader, archivePath string) (*tar.Header, *tar.Reader, error) {
+	input, err := openArchive(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	archive := tar.NewReader(input)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil, nil, fmt.Errorf("%s: not found in archive", archivePath)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if path.Clean(header.Name) == archivePath {
+			return header, archive, nil
+		}
+	}
+}
@@ -0,0 +1,461 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// chunksEncoding is the TARMAC.encoding of a regular file entry whose contents are a chunk manifest: the archive paths
+// of the backing files that hold the file's chunks, one per line, in order. See Options.Chunked. A line may also give
+// the offset and size of the range of the backing file that the chunk spans, separated from the path and each other by
+// spaces, as the lines for files packed with Options.PackSmall do.
+const chunksEncoding = "chunks"
+
+// The bounds on the size of a chunk and the size that chunks average. Chunk boundaries depend on these and on the
+// gear table, so changing any of them prevents new archives from sharing chunks with old ones (but does not affect
+// their correctness).
+const (
+	minChunkSize = 16 << 10
+	avgChunkSize = 64 << 10
+	maxChunkSize = 256 << 10
+)
+
+// The masks that the rolling hash is tested against before and after a chunk reaches the average size. The first
+// has more bits set than log2(avgChunkSize) and the second fewer, which concentrates chunk sizes around the average.
+const (
+	strictChunkMask uint64 = (1<<18 - 1) << (64 - 18)
+	looseChunkMask  uint64 = (1<<14 - 1) << (64 - 14)
+)
+
+// gear maps each byte to a pseudo-random value that is mixed into the rolling hash. It is generated from a fixed seed.
+var gear = GearTable(0)
+
+// GearTable returns a table that maps each byte to a pseudo-random value for a gear hash, a rolling hash such as the
+// one that finds the boundaries of chunks for Options.Chunked. The values are generated using SplitMix64 from seed, so
+// a seed always gives the same table.
+func GearTable(seed uint64) (table [256]uint64) {
+	x := seed
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+// cutPoint returns the size of the chunk that begins data, which is the rest of the contents being chunked or at
+// least maxChunkSize bytes of them. Boundaries are found using FastCDC's gear hash and normalized chunking, so they
+// depend only on the bytes that precede them within a chunk: an insertion or deletion moves the boundaries near it
+// but leaves the rest in place.
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= minChunkSize {
+		return n
+	}
+	if n > maxChunkSize {
+		n = maxChunkSize
+	}
+	normal := avgChunkSize
+	if normal > n {
+		normal = n
+	}
+
+	var fingerprint uint64
+	i := minChunkSize
+	for ; i < normal; i++ {
+		fingerprint = fingerprint<<1 + gear[data[i]]
+		if fingerprint&strictChunkMask == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fingerprint = fingerprint<<1 + gear[data[i]]
+		if fingerprint&looseChunkMask == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// isChunked returns true if header describes a regular file entry whose contents are a chunk manifest.
+func isChunked(header *tar.Header) bool {
+	return header.Typeflag == tar.TypeReg && header.PAXRecords[encodingRecord] == chunksEncoding
+}
+
+// chunkRef is a line of a chunk manifest: the archive path of a backing file and the range of its contents that the
+// chunk spans. The size of a chunk that spans the whole backing file is -1.
+type chunkRef struct {
+	path         string
+	offset, size int64
+}
+
+// parseChunkRef parses a line of a chunk manifest. A backing file's key never contains a space, so a line that ends
+// in two numbers separated by spaces gives a range.
+func parseChunkRef(line string) chunkRef {
+	if i := strings.LastIndexByte(line, ' '); i >= 0 {
+		if j := strings.LastIndexByte(line[:i], ' '); j >= 0 {
+			offset, offsetErr := strconv.ParseInt(line[j+1:i], 10, 64)
+			size, sizeErr := strconv.ParseInt(line[i+1:], 10, 64)
+			if offsetErr == nil && sizeErr == nil && offset >= 0 && size >= 0 {
+				return chunkRef{path: path.Clean(line[:j]), offset: offset, size: size}
+			}
+		}
+	}
+	return chunkRef{path: path.Clean(line), size: -1}
+}
+
+// span returns the offset and size of the chunk's contents within a backing file of the given size, and false if the
+// backing file is too small to hold them.
+func (c chunkRef) span(size int64) (int64, int64, bool) {
+	if c.size < 0 {
+		return 0, size, true
+	}
+	if c.size > size || c.offset > size-c.size {
+		return 0, 0, false
+	}
+	return c.offset, c.size, true
+}
+
+// readManifest reads a chunk manifest from r. Every chunk must be a backing file in one of stores, unless stores is
+// nil, in which case the caller checks the chunks itself.
+func readManifest(r io.Reader, stores storeSet) ([]chunkRef, error) {
+	var chunks []chunkRef
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		chunk := parseChunkRef(scanner.Text())
+		if stores != nil && !stores.contains(chunk.path) {
+			return nil, fmt.Errorf("chunk %s is not a backing file", scanner.Text())
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, scanner.Err()
+}
+
+// addChunkedFile adds a regular file as a chunk manifest whose chunks are stored in the backing store, as is done for
+// every non-empty file with Options.Chunked.
+func (w *Writer) addChunkedFile(entryPath string, header *tar.Header, fi os.FileInfo) error {
+	w.currentPath.Store(header.Name)
+	return w.emit(func() error {
+		return w.writeChunked(entryPath, header, fi)
+	})
+}
+
+// writeChunked splits the contents of the regular file at entryPath into chunks, writes a backing entry for each chunk
+// that is not already in the backing store, and then writes header as the file's chunk manifest. It must be called on
+// the writing goroutine.
+func (w *Writer) writeChunked(entryPath string, header *tar.Header, fi os.FileInfo) error {
+	f, err := w.openFile(entryPath)
+	if err != nil {
+		return w.skip(header.Name, err)
+	}
+	defer f.Close()
+
+	if w.chunkBuffer == nil {
+		w.chunkBuffer = make([]byte, maxChunkSize)
+	}
+	buffer, r := w.chunkBuffer, &contextReader{ctx: w.ctx, r: &progressReader{r: f, bytes: &w.bytesHashed}}
+
+	var manifest strings.Builder
+	var chunks []chunkRef
+	var size int64
+	deduplicated := true
+	var sniffed bool
+	for n, eof := 0, false; ; {
+		if !eof {
+			m, err := io.ReadFull(r, buffer[n:])
+			n += m
+			switch {
+			case err == io.EOF || err == io.ErrUnexpectedEOF:
+				eof = true
+			case err != nil:
+				if ctxErr := w.ctx.Err(); ctxErr != nil {
+					return ctxErr
+				}
+				// Any chunks that were already written are valid backing files, so the file can still be skipped.
+				return w.skip(header.Name, err)
+			}
+		}
+		if n == 0 {
+			break
+		}
+
+		if w.options.Sniff && !sniffed {
+			setContentType(header, contentType(buffer[:n]))
+			sniffed = true
+		}
+
+		cut := cutPoint(buffer[:n])
+		chunk, stored, err := w.storeChunk(header.Name, buffer[:cut], fi)
+		if err != nil {
+			return err
+		}
+		deduplicated = deduplicated && !stored
+		manifest.WriteString(chunk + "\n")
+		chunks = append(chunks, chunkRef{path: chunk, size: -1})
+		size += int64(cut)
+
+		n = copy(buffer, buffer[cut:n])
+	}
+	w.filesHashed.Add(1)
+
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	header.PAXRecords[encodingRecord] = chunksEncoding
+	header.PAXRecords[sizeRecord] = strconv.FormatInt(size, 10)
+	header.Size = int64(manifest.Len())
+
+	err = w.writeHeader(header)
+	if err == nil && !w.options.DryRun {
+		_, err = io.WriteString(w.archive, manifest.String())
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", header.Name, err)
+	}
+	w.chunkedFiles++
+	w.log(slog.LevelDebug, "chunked", "path", header.Name, "size", size)
+	w.indexFile(header.Name, size, chunks...)
+
+	// Report the file as List would, with its logical size.
+	logical := *header
+	logical.Size, logical.PAXRecords = size, logicalRecords(header.PAXRecords)
+	w.added(Entry{Header: &logical, Deduplicated: deduplicated && size > 0})
+	return nil
+}
+
+// storeChunk writes a backing entry for a chunk of the regular file at archivePath, unless it is already in the
+// backing store, and returns the chunk's archive path and whether it was written.
+func (w *Writer) storeChunk(archivePath string, chunk []byte, fi os.FileInfo) (string, bool, error) {
+	hash, err := newHash(w.options.Hash)
+	if err != nil {
+		return "", false, err
+	}
+	hash.Write(chunk)
+	key := hashKey(hash.Sum(nil), w.options.HashBytes)
+	name := path.Join(w.storePath(), key)
+
+	if backing, ok := w.mapping[key]; ok {
+		backing.refs++
+		return name, false, nil
+	}
+
+	err = w.writeAlgorithm()
+	if err != nil {
+		return "", false, err
+	}
+
+	if !w.options.DryRun {
+		header, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return "", false, err
+		}
+		header.Name, header.Size = name, int64(len(chunk))
+
+		if w.options.BackingHook != nil {
+			err = w.writeHooked(key, header, bytes.NewReader(chunk))
+		} else {
+			err = w.writeHeader(header)
+			if err == nil {
+				archive, _ := w.target(name)
+				_, err = archive.Write(chunk)
+			}
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("%s: %v", archivePath, err)
+		}
+	}
+
+	w.mapping[key] = &backingFile{size: int64(len(chunk)), refs: 1, chunk: true}
+	w.log(slog.LevelDebug, "stored", "path", archivePath, "key", key, "size", len(chunk))
+	return name, true, nil
+}
+
+// logicalRecords returns a copy of the PAX records of a chunk manifest without those that describe its encoding, as
+// List reports them.
+func logicalRecords(records map[string]string) map[string]string {
+	records = maps.Clone(records)
+	delete(records, encodingRecord)
+	delete(records, sizeRecord)
+	if len(records) == 0 {
+		return nil
+	}
+	return records
+}
+
+// chunkReader reads the concatenated contents of the given extracted chunks, opening each in turn.
+type chunkReader struct {
+	ctx    *extractionContext
+	chunks []chunkRef
+	f      *os.File
+
+	// r reads the contents of the current chunk from f, of which remaining bytes are left to read of a chunk that spans
+	// a range.
+	r         io.Reader
+	current   string
+	remaining int64
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	for {
+		if r.f == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			chunk := r.chunks[0]
+
+			target, err := r.ctx.resolve(chunk.path)
+			if err != nil {
+				return 0, err
+			}
+			r.f, err = openExtracted(target)
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					return 0, fmt.Errorf("missing chunk %s", chunk.path)
+				}
+				return 0, err
+			}
+			r.r, r.current, r.remaining = r.f, chunk.path, chunk.size
+			if chunk.size >= 0 {
+				r.r = io.NewSectionReader(r.f, chunk.offset, chunk.size)
+			}
+			r.chunks = r.chunks[1:]
+		}
+
+		n, err := r.r.Read(b)
+		if r.remaining > 0 {
+			r.remaining -= int64(n)
+		}
+		if err == io.EOF {
+			r.f.Close()
+			r.f = nil
+			if r.remaining > 0 {
+				return n, fmt.Errorf("chunk %s is shorter than the range it spans", r.current)
+			}
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	return r.f.Close()
+}
+
+// extractChunked extracts the regular file entry with the given header, whose chunk manifest is read from r, by
+// concatenating the chunks that were extracted before it.
+func (ctx *extractionContext) extractChunked(target string, header *tar.Header, r io.Reader) error {
+	chunks, err := readManifest(r, ctx.known)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if !ctx.entries[chunk.path] {
+			return fmt.Errorf("missing chunk %s", chunk.path)
+		}
+		ctx.stores[path.Dir(chunk.path)] = true
+	}
+
+	contents := &chunkReader{ctx: ctx, chunks: chunks}
+	defer contents.Close()
+
+	return ctx.extractFile(target, header, contents)
+}
+
+// catChunks writes the contents of the regular file entry with the given header, whose chunk manifest is read from
+// archive, to w. The archive in r is read a second time to copy the chunks to a temporary file, from which they are
+// then written in order. Chunks that are not found in a backing store are missing.
+func catChunks(r io.ReadSeeker, header *tar.Header, archive io.Reader, w io.Writer) error {
+	// The backing stores are not known until the archive is read again.
+	chunks, err := readManifest(archive, nil)
+	if err != nil {
+		return err
+	}
+
+	// The offsets and sizes of the chunks in the temporary file.
+	type span struct{ offset, size int64 }
+	spans := make(map[string]*span)
+	for _, chunk := range chunks {
+		spans[chunk.path] = nil
+	}
+
+	f, err := os.CreateTemp("", "tarmac-chunks")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("cannot reread the archive to find the chunks: %v", err)
+	}
+	input, err := openArchive(r)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	stores := make(storeSet)
+	entries := tar.NewReader(input)
+	for {
+		entry, err := entries.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		stores.observe(entry)
+		name := path.Clean(entry.Name)
+		if s, ok := spans[name]; !ok || s != nil || entry.Typeflag != tar.TypeReg || !stores.contains(name) {
+			continue
+		}
+
+		contents, err := contents(entry, entries)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(f, contents)
+		if err != nil {
+			return err
+		}
+		spans[name] = &span{offset: offset, size: n}
+		offset += n
+	}
+
+	for _, chunk := range chunks {
+		s := spans[chunk.path]
+		if s == nil {
+			return fmt.Errorf("missing chunk %s", chunk.path)
+		}
+		offset, size, ok := chunk.span(s.size)
+		if !ok {
+			return fmt.Errorf("chunk %s is shorter than the range it spans", chunk.path)
+		}
+		_, err = io.Copy(w, io.NewSectionReader(f, s.offset+offset, size))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
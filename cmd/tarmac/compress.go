@@ -0,0 +1,154 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pgavlin/tarmac"
+	"github.com/ulikunitz/xz"
+)
+
+// compression is a flag.Value that names the compression format used for created archives. It may be given as a plain
+// boolean flag (-compress), in which case gzip is used, or with an explicit format (-compress=zstd).
+type compression string
+
+func (c *compression) String() string {
+	return string(*c)
+}
+
+func (c *compression) Set(value string) error {
+	switch value {
+	case "true":
+		*c = "gzip"
+	case "false", "none":
+		*c = ""
+	default:
+		if _, ok := compressors[compression(value)]; !ok {
+			return fmt.Errorf("unknown compression format %q", value)
+		}
+		*c = compression(value)
+	}
+	return nil
+}
+
+func (c *compression) IsBoolFlag() bool {
+	return true
+}
+
+// defaultLevel selects the default compression level of the chosen format.
+const defaultLevel = -1
+
+// xzDictCaps are the dictionary sizes of xz's presets 0 to 9.
+var xzDictCaps = [...]int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// compressors maps the name of each supported compression format to a function that wraps w in an encoder for that
+// format. Level ranges from 0 (fastest) to 9 (best compression), or is defaultLevel. Closing the encoder flushes it but
+// does not close w.
+var compressors = map[compression]func(w io.Writer, level int) (io.WriteCloser, error){
+	"gzip": func(w io.Writer, level int) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, level)
+	},
+	"zstd": func(w io.Writer, level int) (io.WriteCloser, error) {
+		if level == defaultLevel {
+			return zstd.NewWriter(w)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	},
+	"bzip2": func(w io.Writer, level int) (io.WriteCloser, error) {
+		// bzip2 levels range from 1 to 9, and zero selects the default.
+		switch level {
+		case defaultLevel:
+			level = 0
+		case 0:
+			level = bzip2.BestSpeed
+		}
+		return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: level})
+	},
+	"xz": func(w io.Writer, level int) (io.WriteCloser, error) {
+		// The xz encoder does not offer compression levels, so a level selects the dictionary size of the
+		// corresponding xz preset instead.
+		if level == defaultLevel {
+			return xz.NewWriter(w)
+		}
+		return xz.WriterConfig{DictCap: xzDictCaps[level]}.NewWriter(w)
+	},
+}
+
+// compressor wraps w in an encoder for the given compression format. If rsyncable is set, gzip output is made
+// rsync-friendly (see rsyncableWriter).
+func compressor(format compression, level int, rsyncable bool, w io.Writer) (io.WriteCloser, error) {
+	if format == "gzip" && rsyncable {
+		return newRsyncableWriter(w, level)
+	}
+
+	newWriter, ok := compressors[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression format %q", string(format))
+	}
+	return newWriter(w, level)
+}
+
+// The boundaries of an rsyncableWriter's chunks are determined by a gear hash of its input, which depends only on the
+// last 64 bytes. A chunk ends wherever the top rsyncBits bits of the hash are zero, so long as it is at least
+// rsyncMinChunk bytes long, which makes the average chunk about 1<<rsyncBits bytes longer than the minimum.
+const (
+	rsyncBits     = 15
+	rsyncMinChunk = 8 << 10
+)
+
+// rsyncGear maps each byte to a pseudorandom value for the gear hash. It is generated from a fixed seed, as the
+// boundaries of chunks must not change between runs.
+var rsyncGear = tarmac.GearTable(0x7461726d6163)
+
+// rsyncableWriter is a gzip encoder whose output only depends on nearby input, similar to gzip --rsyncable. The input
+// is split into chunks at content-defined boundaries, and each chunk is compressed as a separate gzip member. A change
+// to the input therefore only changes the compressed chunks around it, and the rest of the output remains identical,
+// which allows tools like rsync to transfer only the differences. Gzip decoders read the concatenated members as a
+// single stream.
+type rsyncableWriter struct {
+	w  io.Writer
+	gz *gzip.Writer
+
+	hash   uint64
+	length int
+}
+
+func newRsyncableWriter(w io.Writer, level int) (*rsyncableWriter, error) {
+	gz, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	return &rsyncableWriter{w: w, gz: gz}, nil
+}
+
+func (r *rsyncableWriter) Write(b []byte) (int, error) {
+	written := 0
+	for i, c := range b {
+		r.hash = r.hash<<1 + rsyncGear[c]
+		r.length++
+
+		if r.length >= rsyncMinChunk && r.hash>>(64-rsyncBits) == 0 {
+			// End the chunk here and begin a new gzip member, which does not refer back to earlier input.
+			n, err := r.gz.Write(b[written : i+1])
+			written += n
+			if err != nil {
+				return written, err
+			}
+			if err = r.gz.Close(); err != nil {
+				return written, err
+			}
+			r.gz.Reset(r.w)
+			r.length = 0
+		}
+	}
+
+	n, err := r.gz.Write(b[written:])
+	return written + n, err
+}
+
+func (r *rsyncableWriter) Close() error {
+	return r.gz.Close()
+}
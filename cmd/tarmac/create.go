@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pgavlin/tarmac"
+)
+
+// creation describes an archive to create from the command line.
+type creation struct {
+	roots        []string
+	names        []string
+	outputPath   string
+	appendPath   string
+	basePath     string
+	prefix       string
+	manifestPath string
+	checksumPath string
+	blobsPath    string
+	volumeSize   int64
+	fsync        bool
+	files        []string
+	tarInput     io.Reader
+	progress     bool
+	compress     compression
+	level        int
+	rsyncable    bool
+	maxTotal     int64
+	stats        bool
+	format       outputFormat
+	options      tarmac.Options
+
+	// stop, if non-nil, is closed to stop adding entries, leaving an archive of those that were already found.
+	stop <-chan struct{}
+
+	// skipped is the number of unreadable entries that were skipped.
+	skipped int
+	// stopped is set if the archive was stopped before every entry was added.
+	stopped bool
+}
+
+// run archives the directories at roots to the file at outputPath, or to stdout if outputPath is empty. If appendPath
+// is set, the directory is instead appended to the archive at that path. If manifestPath is set, a manifest of the
+// archived entries is written to that path as well.
+func (c *creation) run(ctx context.Context) (err error) {
+	if c.manifestPath == "" {
+		return c.write(ctx)
+	}
+
+	f, err := createOutput(c.manifestPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Abort()
+		}
+	}()
+
+	out := bufio.NewWriter(f)
+	m := &manifest{w: out}
+	c.options.OnEntry = m.add
+
+	err = c.write(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = m.close()
+	if err != nil {
+		return err
+	}
+
+	err = out.Flush()
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// write creates or appends to the archive.
+func (c *creation) write(ctx context.Context) (err error) {
+	if c.appendPath != "" {
+		return c.append(ctx)
+	}
+
+	dest := io.WriteCloser(os.Stdout)
+	switch {
+	case c.options.DryRun:
+		// Nothing is written in a dry run, so leave the destination untouched.
+		dest = discard{}
+	case c.outputPath != "" && c.volumeSize > 0:
+		var volumes *volumeWriter
+		volumes, err = createVolumes(c.outputPath, c.volumeSize, c.fsync)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				volumes.Abort()
+			}
+		}()
+		dest = volumes
+	case c.outputPath != "":
+		var f *outputFile
+		f, err = createOutput(c.outputPath)
+		if err != nil {
+			return err
+		}
+		f.durable = c.fsync
+		defer func() {
+			if err != nil {
+				f.Abort()
+			}
+		}()
+		dest = f
+	}
+
+	var limited *limitWriter
+	if c.maxTotal > 0 {
+		limited = &limitWriter{WriteCloser: dest, limit: c.maxTotal}
+		dest = limited
+	}
+
+	// Hash exactly the bytes that are written to the destination.
+	var checksum hash.Hash
+	if c.checksumPath != "" {
+		checksum = sha256.New()
+		dest = struct {
+			io.Writer
+			io.Closer
+		}{io.MultiWriter(dest, checksum), dest}
+	}
+
+	output := dest
+	if c.compress != "" {
+		output, err = compressor(c.compress, c.level, c.rsyncable, dest)
+		if err != nil {
+			return err
+		}
+	}
+
+	var blobs *splitOutput
+	if c.blobsPath != "" && !c.options.DryRun {
+		blobs, err = c.createBlobs()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				blobs.file.Abort()
+			}
+		}()
+		c.options.Blobs = blobs.output
+	}
+
+	archive := tarmac.NewWriterOptions(output, c.rootArchivePath(), c.options)
+	if limited != nil {
+		defer func() {
+			if err != nil && limited.exceeded {
+				err = &limitError{limit: c.maxTotal, progress: archive.Progress()}
+			}
+		}()
+	}
+
+	if c.basePath != "" {
+		err = addBase(archive, c.basePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.add(ctx, archive)
+	if err != nil {
+		return err
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return err
+	}
+
+	stats := archive.Stats()
+	if c.stats {
+		printStats(stats, c.format)
+	}
+	c.skipped = stats.Skipped
+
+	if output != dest {
+		err = output.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if blobs != nil {
+		err = blobs.close()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = dest.Close()
+	if err != nil {
+		return err
+	}
+
+	if checksum != nil {
+		return c.writeChecksum(checksum.Sum(nil))
+	}
+	return nil
+}
+
+// splitOutput is the file to which the backing store is written with -split, compressed as the archive is.
+type splitOutput struct {
+	file   *outputFile
+	output io.WriteCloser
+}
+
+// createBlobs creates the file at blobsPath.
+func (c *creation) createBlobs() (*splitOutput, error) {
+	f, err := createOutput(c.blobsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	output := io.WriteCloser(f)
+	if c.compress != "" {
+		output, err = compressor(c.compress, c.level, c.rsyncable, f)
+		if err != nil {
+			f.Abort()
+			return nil, err
+		}
+	}
+	return &splitOutput{file: f, output: output}, nil
+}
+
+func (s *splitOutput) close() error {
+	if s.output != io.WriteCloser(s.file) {
+		if err := s.output.Close(); err != nil {
+			return err
+		}
+	}
+	return s.file.Close()
+}
+
+// writeChecksum writes the SHA-256 digest of the archive to checksumPath in the format used by sha256sum.
+func (c *creation) writeChecksum(sum []byte) (err error) {
+	f, err := createOutput(c.checksumPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Abort()
+		}
+	}()
+
+	// The checksum of an archive split into volumes is that of their concatenation, which is checked from stdin.
+	name := "-"
+	if c.outputPath != "" && c.volumeSize == 0 {
+		_, name = filepath.Split(c.outputPath)
+	}
+
+	_, err = fmt.Fprintf(f, "%s  %s\n", hex.EncodeToString(sum), name)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// add adds the entries of the input archive if one was given, the files if a list of files was given, or the trees at
+// roots otherwise. If there is more than one root, each tree is archived under its name. If stop is closed first, add
+// sets stopped and returns without error once the entries that were already found have been written.
+func (c *creation) add(ctx context.Context, archive *tarmac.Writer) error {
+	if c.progress {
+		stop := reportProgress(archive)
+		defer stop()
+	}
+
+	if c.stop != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-c.stop:
+				archive.Stop()
+			case <-done:
+			}
+		}()
+	}
+
+	err := c.addEntries(ctx, archive)
+	if errors.Is(err, tarmac.ErrStopped) {
+		c.stopped = true
+		return nil
+	}
+	return err
+}
+
+// addEntries adds the entries to archive for add.
+func (c *creation) addEntries(ctx context.Context, archive *tarmac.Writer) error {
+	if c.tarInput != nil {
+		return archive.AddTarContext(ctx, c.tarInput)
+	}
+	if c.files != nil {
+		return archive.AddFilesContext(ctx, c.roots[0], c.files)
+	}
+
+	if len(c.roots) == 1 {
+		return archive.AddTreeContext(ctx, c.roots[0])
+	}
+	for i, root := range c.roots {
+		if err := archive.AddTreeAtContext(ctx, root, c.name(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addBase records the contents stored in the archive at basePath so that the archive refers to them rather than
+// storing them again.
+func addBase(archive *tarmac.Writer, basePath string) error {
+	f, err := os.Open(basePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = archive.AddBase(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", basePath, err)
+	}
+	return nil
+}
+
+// discard is an io.WriteCloser that discards its input.
+type discard struct{}
+
+func (discard) Write(b []byte) (int, error) { return len(b), nil }
+func (discard) Close() error                { return nil }
+
+// rootArchivePath returns the path under which the trees are archived: the prefix, if any, or the name of the root if
+// there is only one. If there are several roots and no prefix, the trees are archived at the top level of the archive.
+func (c *creation) rootArchivePath() string {
+	if c.prefix != "" || len(c.roots) != 1 {
+		return c.prefix
+	}
+	return c.name(0)
+}
+
+// name returns the name under which the root at index i is archived: the name given in names, if any, or the root's
+// base name.
+func (c *creation) name(i int) string {
+	if c.names != nil {
+		return c.names[i]
+	}
+	_, name := filepath.Split(c.roots[i])
+	return name
+}
+
+// append adds the directories at roots to the existing archive at appendPath. If this fails, the archive is truncated
+// to its original entries.
+func (c *creation) append(ctx context.Context) (err error) {
+	f, err := os.OpenFile(c.appendPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+
+	archive, err := tarmac.NewAppendWriter(f, c.rootArchivePath(), c.options)
+	if err != nil {
+		return err
+	}
+
+	end, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			// Replace any partially-written entries with a new footer.
+			if f.Truncate(end) == nil {
+				f.WriteAt(make([]byte, 2*512), end)
+			}
+		}
+	}()
+
+	err = c.add(ctx, archive)
+	if err != nil {
+		return err
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return err
+	}
+
+	stats := archive.Stats()
+	if c.stats {
+		printStats(stats, c.format)
+	}
+	c.skipped = stats.Skipped
+
+	if c.fsync {
+		if err = f.Sync(); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// outputFiles returns the Options.ExcludeFiles entries for the files that tarmac writes, and their temporary files, so
+// that none of them is archived if it lies within a tree.
+func (c *creation) outputFiles() []string {
+	var files []string
+	for _, p := range []string{c.outputPath, c.appendPath, c.manifestPath, c.checksumPath, c.blobsPath} {
+		if p == "" {
+			continue
+		}
+		dir, name := filepath.Dir(p), escapePattern(filepath.Base(p))
+		files = append(files, filepath.Join(dir, name), filepath.Join(dir, escapePattern(filepath.Base(tempPath(p)))))
+		if p == c.outputPath && c.volumeSize > 0 {
+			// The volumes and their temporary files, e.g. archive.000 and archive.000.1234.tmp.
+			files = append(files, filepath.Join(dir, name+".[0-9][0-9][0-9]*"))
+		}
+	}
+	return files
+}
+
+// escapePattern escapes the characters in name that filepath.Match treats specially, so that the resulting pattern
+// matches only name.
+func escapePattern(name string) string {
+	var b strings.Builder
+	for _, c := range name {
+		switch c {
+		case '*', '?', '[':
+			b.WriteString("[" + string(c) + "]")
+		case '\\':
+			b.WriteString(`\\`)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// printStats prints a summary of the deduplication performed while creating an archive to stderr in the given format:
+// as a sentence, as a JSON object, or as a CSV header and row.
+func printStats(stats tarmac.Stats, format outputFormat) {
+	switch format {
+	case jsonFormat:
+		record, _ := json.Marshal(statsRecord{
+			Files:        stats.Files,
+			UniqueFiles:  stats.UniqueFiles,
+			StoredBytes:  stats.StoredBytes,
+			DedupedBytes: stats.DedupedBytes,
+			Skipped:      stats.Skipped,
+		})
+		fmt.Fprintf(os.Stderr, "%s\n", record)
+	case csvFormat:
+		fmt.Fprintf(os.Stderr, "files,unique_files,stored_bytes,deduped_bytes,skipped\n%d,%d,%d,%d,%d\n", stats.Files,
+			stats.UniqueFiles, stats.StoredBytes, stats.DedupedBytes, stats.Skipped)
+	default:
+		fmt.Fprintf(os.Stderr, "%d files, %d unique, %s stored, %s deduped\n", stats.Files, stats.UniqueFiles,
+			formatBytes(stats.StoredBytes), formatBytes(stats.DedupedBytes))
+	}
+}
+
+// statsRecord is the JSON form of the statistics printed by -stats.
+type statsRecord struct {
+	Files        int   `json:"files"`
+	UniqueFiles  int   `json:"unique_files"`
+	StoredBytes  int64 `json:"stored_bytes"`
+	DedupedBytes int64 `json:"deduped_bytes"`
+	Skipped      int   `json:"skipped"`
+}
+
+// formatBytes formats a byte count using binary units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
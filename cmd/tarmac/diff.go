@@ -0,0 +1,136 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pgavlin/tarmac"
+)
+
+// diff compares the trees that c would archive with the archive at archivePath, without writing anything, and prints
+// each path that has been added, removed, or modified since the archive was written to w. The trees are walked and
+// hashed exactly as they would be archived, using the archive's hash algorithm. It returns the number of differences.
+func (c *creation) diff(ctx context.Context, archivePath string, w io.Writer) (int, error) {
+	f, err := openArchiveFile(archivePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	archived, hasStore := make(map[string]tarmac.Entry), false
+	err = tarmac.List(f, func(entry tarmac.Entry) error {
+		archived[path.Clean(entry.Header.Name)] = entry
+		hasStore = hasStore || entry.Key != ""
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", archivePath, err)
+	}
+
+	current := make(map[string]tarmac.Entry)
+	options := c.options
+	options.DryRun, options.SkipHashing = true, false
+	options.NoDedup, options.Chunked, options.SortedStore = false, false, false
+	options.PackSmall, options.LinkToFirst = 0, false
+	options.OnEntry = func(entry tarmac.Entry) {
+		current[path.Clean(entry.Header.Name)] = entry
+	}
+
+	archive := tarmac.NewWriterOptions(discard{}, c.rootArchivePath(), options)
+	if hasStore {
+		// Reading the archive's backing store selects its hash algorithm, so that the keys are comparable.
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if err = archive.AddBase(f); err != nil {
+			return 0, fmt.Errorf("%s: %v", archivePath, err)
+		}
+	}
+	if err = c.add(ctx, archive); err != nil {
+		return 0, err
+	}
+	if err = archive.Close(); err != nil {
+		return 0, err
+	}
+	c.skipped = archive.Stats().Skipped
+
+	names := make([]string, 0, len(archived)+len(current))
+	for name := range archived {
+		names = append(names, name)
+	}
+	for name := range current {
+		if _, ok := archived[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	differences := 0
+	for _, name := range names {
+		was, wasArchived := archived[name]
+		is, isCurrent := current[name]
+
+		var line string
+		switch {
+		case !wasArchived:
+			line = "Added: " + name
+		case !isCurrent:
+			line = "Removed: " + name
+		default:
+			changes := compareEntries(was, is)
+			if len(changes) == 0 {
+				continue
+			}
+			line = fmt.Sprintf("Modified: %s (%s)", name, strings.Join(changes, ", "))
+		}
+		if _, err = fmt.Fprintln(w, line); err != nil {
+			return 0, err
+		}
+		differences++
+	}
+	return differences, nil
+}
+
+// compareEntries returns the aspects in which the current entry for a path differs from its archived entry. The
+// modification times of directories are not compared, as they change whenever their entries do.
+func compareEntries(was, is tarmac.Entry) []string {
+	before, after := was.Header, is.Header
+	if before.Typeflag != after.Typeflag {
+		return []string{"type"}
+	}
+
+	var changes []string
+	switch before.Typeflag {
+	case tar.TypeReg:
+		// Files that are not stored in the backing store as a whole, such as chunked files, have no key to compare.
+		if before.Size != after.Size || (was.Key != "" && was.Key != is.Key) {
+			changes = append(changes, "contents")
+		}
+	case tar.TypeLink, tar.TypeSymlink:
+		if before.Linkname != after.Linkname {
+			changes = append(changes, "target")
+		}
+	}
+	if before.Mode&07777 != after.Mode&07777 {
+		changes = append(changes, "mode")
+	}
+	if before.Typeflag != tar.TypeDir && !sameTime(before.ModTime, after.ModTime) {
+		changes = append(changes, "mtime")
+	}
+	return changes
+}
+
+// sameTime returns true if the current modification time of an entry matches its archived time. Archives that are not
+// written in the PAX format round times to the nearest second.
+func sameTime(archived, current time.Time) bool {
+	if archived.Nanosecond() == 0 {
+		current = current.Round(time.Second)
+	}
+	return archived.Equal(current)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// environment lists the environment variables that provide defaults for flags. A variable's value is used as if it
+// had been given as the flag, unless the flag is given on the command line, in which case the variable is ignored.
+// The variable is also ignored if any of the flags that cannot be combined with its flag (conflicts) are given on the
+// command line, as it only supplies a default. The value of a variable for a repeatable flag is a list of values
+// separated by the OS's path list separator (':' on Unix).
+var environment = []struct {
+	variable, flag string
+	list           bool
+	conflicts      []string
+}{
+	{"TARMAC_EXCLUDE", "exclude", true, nil},
+	{"TARMAC_COMPRESS", "compress", false, []string{"append", "index", "per-file-compress"}},
+	{"TARMAC_JOBS", "jobs", false, nil},
+}
+
+// readEnvironment returns the values of the environment variables in environment that are set, keyed by the name of
+// their flag.
+func readEnvironment() map[string][]string {
+	values := make(map[string][]string)
+	for _, v := range environment {
+		value, ok := os.LookupEnv(v.variable)
+		if !ok {
+			continue
+		}
+		if v.list {
+			values[v.flag] = filepath.SplitList(value)
+		} else {
+			values[v.flag] = []string{value}
+		}
+	}
+	return values
+}
+
+// applyEnvironment sets each flag that was not given on the command line, nor any of its conflicts, to the values read
+// from its environment variable. It must be called after flag.Parse.
+func applyEnvironment(values map[string][]string) error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for _, v := range environment {
+		if given[v.flag] || slices.ContainsFunc(v.conflicts, func(name string) bool { return given[name] }) {
+			continue
+		}
+		for _, value := range values[v.flag] {
+			if err := flag.Set(v.flag, value); err != nil {
+				return fmt.Errorf("invalid value %q for %s: %v", value, v.variable, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readFiles reads the list of paths in the named file, or in stdin if the name is "-".
+func readFiles(name string) ([]string, error) {
+	if name == "-" {
+		return readFileList(os.Stdin)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readFileList(f)
+}
+
+// readFileList reads a newline-delimited list of paths from r, ignoring blank lines, and returns their absolute
+// paths.
+func readFileList(r io.Reader) ([]string, error) {
+	var paths []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		p, err := filepath.Abs(line)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return paths, nil
+}
+
+// commonRoot returns the deepest directory that contains all of the given absolute paths. A path that names a
+// directory may itself be the common root.
+func commonRoot(paths []string) string {
+	root := ""
+	for _, p := range paths {
+		dir := p
+		if fi, err := os.Stat(p); err != nil || !fi.IsDir() {
+			dir = filepath.Dir(p)
+		}
+
+		if root == "" {
+			root = dir
+			continue
+		}
+		for !isWithin(dir, root) {
+			root = filepath.Dir(root)
+		}
+	}
+	return root
+}
+
+// isWithin returns true if the path p is dir or lies beneath it.
+func isWithin(p, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,27 @@
+package main
+
+import "fmt"
+
+// outputFormat is the format in which -list and -stats print their output: human-readable text, JSON for programs,
+// or CSV for spreadsheets.
+type outputFormat string
+
+const (
+	textFormat outputFormat = "text"
+	jsonFormat outputFormat = "json"
+	csvFormat  outputFormat = "csv"
+)
+
+func (f *outputFormat) String() string {
+	return string(*f)
+}
+
+func (f *outputFormat) Set(value string) error {
+	switch format := outputFormat(value); format {
+	case textFormat, jsonFormat, csvFormat:
+		*f = format
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q", value)
+	}
+}
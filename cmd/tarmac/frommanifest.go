@@ -0,0 +1,257 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sourceRecord describes an entry to archive with -from-manifest: the archive path of the entry, the file from which
+// its contents (or target, for a symlink) are read, and its mode and modification time. The mode is either as written
+// by -manifest (e.g. -rw-r--r--) or an octal permission mode, in which case the type is that of the source. An empty
+// mode or mtime is taken from the source. A directory needs no source if its mode and mtime are given.
+type sourceRecord struct {
+	Path   string    `json:"path"`
+	Source string    `json:"source"`
+	Mode   string    `json:"mode"`
+	MTime  time.Time `json:"mtime"`
+}
+
+// readSources reads the JSON array of source records in the named file, or in stdin if the name is "-".
+func readSources(name string) ([]sourceRecord, error) {
+	r := io.Reader(os.Stdin)
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var records []sourceRecord
+	if err := json.NewDecoder(r).Decode(&records); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return records, nil
+}
+
+// sourceArchive is the tar archive of the entries described by a list of source records, which -from-manifest adds
+// to the archive as -from-tar would.
+type sourceArchive struct {
+	root    string
+	entries []sourceEntry
+}
+
+// sourceEntry is an entry of a sourceArchive.
+type sourceEntry struct {
+	path   string
+	source string
+	header *tar.Header
+}
+
+// newSourceArchive checks each source record and prepares its header. Every entry must lie within the same top-level
+// directory, which is returned as the archive's root; the headers' names are relative to it. An error is returned for
+// each record whose source is missing or does not match its mode.
+func newSourceArchive(records []sourceRecord) (*sourceArchive, []error) {
+	archive := &sourceArchive{}
+
+	var errs []error
+	for _, record := range records {
+		name := strings.Trim(path.Clean("/"+record.Path), "/")
+		root, rest, _ := strings.Cut(name, "/")
+		if archive.root == "" {
+			archive.root = root
+		}
+		if root == "" || root != archive.root {
+			errs = append(errs, fmt.Errorf("%s: every entry must lie within the top-level directory %s", record.Path,
+				archive.root))
+			continue
+		}
+
+		header, err := sourceHeader(record)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", record.Path, err))
+			continue
+		}
+		// The root directory's own entry is named for the root.
+		header.Name = rest
+		if rest == "" {
+			header.Name = "."
+		}
+		archive.entries = append(archive.entries, sourceEntry{path: record.Path, source: record.Source, header: header})
+	}
+	if len(records) == 0 {
+		errs = append(errs, errors.New("the manifest lists no entries"))
+	}
+	return archive, errs
+}
+
+// sourceHeader returns the header of the entry described by record.
+func sourceHeader(record sourceRecord) (*tar.Header, error) {
+	mode, typed, err := parseMode(record.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if record.Source == "" {
+		if !typed || !mode.IsDir() || record.MTime.IsZero() {
+			return nil, errors.New("no source given")
+		}
+		return &tar.Header{Typeflag: tar.TypeDir, Mode: tarMode(mode), ModTime: record.MTime}, nil
+	}
+
+	fi, err := os.Lstat(record.Source)
+	if err != nil {
+		return nil, fmt.Errorf("source: %v", err)
+	}
+	switch {
+	case record.Mode == "":
+		mode = fi.Mode()
+	case !typed:
+		mode |= fi.Mode().Type()
+	case mode.Type() != fi.Mode().Type():
+		return nil, fmt.Errorf("source %s is not of mode %s", record.Source, record.Mode)
+	}
+
+	var target string
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		if target, err = os.Readlink(record.Source); err != nil {
+			return nil, fmt.Errorf("source: %v", err)
+		}
+	}
+
+	header, err := tar.FileInfoHeader(fi, target)
+	if err != nil {
+		return nil, fmt.Errorf("source: %v", err)
+	}
+	header.Mode = tarMode(mode)
+	if !record.MTime.IsZero() {
+		header.ModTime = record.MTime
+	}
+	return header, nil
+}
+
+// fileModeLetters are the letters with which fs.FileMode.String shows the type and special bits of a mode, in order
+// of bit, starting with the most significant.
+const fileModeLetters = "dalTLDpSugct?"
+
+// parseMode parses a mode as written by fs.FileMode.String, or an octal permission mode. It returns whether the mode
+// includes a type, which an octal mode does not. An empty mode is returned as zero.
+func parseMode(s string) (fs.FileMode, bool, error) {
+	if s == "" {
+		return 0, false, nil
+	}
+	if n, err := strconv.ParseUint(s, 8, 32); err == nil && n <= 07777 {
+		return fs.FileMode(n&0777) | specialBits(n), false, nil
+	}
+
+	if len(s) < 10 {
+		return 0, false, fmt.Errorf("invalid mode %q", s)
+	}
+	letters, perm := s[:len(s)-9], s[len(s)-9:]
+
+	if letters == "-" {
+		letters = ""
+	}
+
+	var mode fs.FileMode
+	for _, c := range letters {
+		i := strings.IndexRune(fileModeLetters, c)
+		if i < 0 {
+			return 0, false, fmt.Errorf("invalid mode %q", s)
+		}
+		mode |= 1 << (32 - 1 - i)
+	}
+	for i := 0; i < len(perm); i++ {
+		switch perm[i] {
+		case "rwxrwxrwx"[i]:
+			mode |= 1 << (8 - i)
+		case '-':
+		default:
+			return 0, false, fmt.Errorf("invalid mode %q", s)
+		}
+	}
+	return mode, true, nil
+}
+
+// specialBits returns the setuid, setgid, and sticky bits of the octal mode n as fs.FileMode bits.
+func specialBits(n uint64) fs.FileMode {
+	var mode fs.FileMode
+	if n&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if n&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if n&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+// tarMode returns the permission and special bits of mode as they are recorded in a tar header.
+func tarMode(mode fs.FileMode) int64 {
+	m := int64(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 01000
+	}
+	return m
+}
+
+// reader returns a reader for the archive, which is written on a separate goroutine. The contents of each regular file
+// are read from its source as it is written; if a source cannot be read, the archive fails with an error that names
+// its entry.
+func (a *sourceArchive) reader() io.Reader {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(a.write(w))
+	}()
+	return r
+}
+
+func (a *sourceArchive) write(w io.Writer) error {
+	archive := tar.NewWriter(w)
+	for _, entry := range a.entries {
+		if err := writeSourceEntry(archive, entry); err != nil {
+			return fmt.Errorf("%s: %v", entry.path, err)
+		}
+	}
+	return archive.Close()
+}
+
+// writeSourceEntry writes an entry to archive, reading the contents of a regular file from its source.
+func writeSourceEntry(archive *tar.Writer, entry sourceEntry) error {
+	if entry.header.Typeflag != tar.TypeReg {
+		return archive.WriteHeader(entry.header)
+	}
+
+	f, err := os.Open(entry.source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := archive.WriteHeader(entry.header); err != nil {
+		return err
+	}
+	n, err := io.Copy(archive, f)
+	if errors.Is(err, tar.ErrWriteTooLong) || (err == nil && n != entry.header.Size) {
+		err = fmt.Errorf("%s changed size while it was read", entry.source)
+	}
+	return err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readIDMap reads the mapping of user or group IDs in the named file, which lists one mapping per line as FROM:TO,
+// ignoring blank lines and lines that begin with #. It returns nil if the name is empty.
+func readIDMap(name string) (map[int]int, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ids := make(map[int]int)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		from, to, ok := strings.Cut(text, ":")
+		fromID, fromErr := strconv.Atoi(strings.TrimSpace(from))
+		toID, toErr := strconv.Atoi(strings.TrimSpace(to))
+		if !ok || fromErr != nil || toErr != nil || fromID < 0 || toID < 0 {
+			return nil, fmt.Errorf("%s:%d: invalid mapping %q (want FROM:TO)", name, line, text)
+		}
+		if _, ok := ids[fromID]; ok {
+			return nil, fmt.Errorf("%s:%d: %d is already mapped", name, line, fromID)
+		}
+		ids[fromID] = toID
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/pgavlin/tarmac"
+)
+
+// errLimitExceeded is returned by a limitWriter for a write that would exceed its limit.
+var errLimitExceeded = errors.New("archive size limit exceeded")
+
+// limitWriter is an io.WriteCloser that refuses writes that would take the total number of bytes written to the
+// underlying io.WriteCloser past a limit. Nothing is written by a refused write.
+type limitWriter struct {
+	io.WriteCloser
+	limit, written int64
+	exceeded       bool
+}
+
+func (w *limitWriter) Write(b []byte) (int, error) {
+	if w.written+int64(len(b)) > w.limit {
+		w.exceeded = true
+		return 0, errLimitExceeded
+	}
+
+	n, err := w.WriteCloser.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// limitError reports that an archive was abandoned because it would have exceeded the size given by -max-total.
+type limitError struct {
+	limit    int64
+	progress tarmac.Progress
+}
+
+func (e *limitError) Error() string {
+	msg := fmt.Sprintf("the archive would exceed %d bytes; stopped after hashing %d files (%s)", e.limit,
+		e.progress.Files, formatBytes(e.progress.Bytes))
+	if e.progress.Path != "" {
+		msg += " at " + e.progress.Path
+	}
+	return msg
+}
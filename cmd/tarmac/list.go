@@ -0,0 +1,69 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/pgavlin/tarmac"
+)
+
+// list prints the logical contents of the archive in r to w in the given format. As text, each entry is printed on
+// its own line in the style of tar -tv; if long is true, the backing store key of each regular file is printed as
+// well, so that files with identical contents can be identified. As JSON, the entries are printed as an array of
+// manifest records, and as CSV, as rows of path, hash, size, mode, and mtime, both of which always include the keys.
+func list(r io.Reader, w io.Writer, long bool, format outputFormat) error {
+	out := bufio.NewWriter(w)
+
+	var err error
+	switch format {
+	case jsonFormat:
+		m := &manifest{w: out}
+		err = tarmac.List(r, func(entry tarmac.Entry) error {
+			m.add(entry)
+			return m.err
+		})
+		if err == nil {
+			err = m.close()
+		}
+	case csvFormat:
+		records := csv.NewWriter(out)
+		records.Write([]string{"path", "hash", "size", "mode", "mtime"})
+		err = tarmac.List(r, func(entry tarmac.Entry) error {
+			header := entry.Header
+			return records.Write([]string{header.Name, entry.Key, strconv.FormatInt(header.Size, 10),
+				header.FileInfo().Mode().String(), header.ModTime.UTC().Format(time.RFC3339Nano)})
+		})
+		records.Flush()
+		if err == nil {
+			err = records.Error()
+		}
+	default:
+		err = tarmac.List(r, func(entry tarmac.Entry) error {
+			header := entry.Header
+
+			line := fmt.Sprintf("%s %12d %s %s", header.FileInfo().Mode(), header.Size, header.ModTime.Format("2006-01-02 15:04"), header.Name)
+			switch header.Typeflag {
+			case tar.TypeSymlink:
+				line += " -> " + header.Linkname
+			case tar.TypeLink:
+				line += " link to " + header.Linkname
+			}
+			if long && entry.Key != "" {
+				line += " " + entry.Key
+			}
+
+			_, err := fmt.Fprintln(out, line)
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	return out.Flush()
+}
@@ -0,0 +1,784 @@
+// Command tarmac creates and extracts tar archives with hash-based deduplication.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pgavlin/tarmac"
+)
+
+func main() {
+	flag.Usage = func() {
+		_, program := filepath.Split(os.Args[0])
+		fmt.Fprintf(os.Stderr, "usage: %s [OPTIONS] [DIR... | FILE]\n", program)
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nThe environment variables TARMAC_EXCLUDE (a %q-separated list of patterns), TARMAC_COMPRESS, and TARMAC_JOBS\n"+
+			"provide defaults for -exclude, -compress, and -jobs. A flag given on the command line overrides its variable, and\n"+
+			"TARMAC_COMPRESS is ignored with -append, -index, or -per-file-compress.\n", filepath.ListSeparator)
+	}
+
+	var compress compression
+	flag.Var(&compress, "compress", "compress output using gzip, or using `FORMAT` (gzip, zstd, bzip2, xz, or none) if given as -compress=FORMAT")
+	level := flag.Int("level", defaultLevel, "compress output at level `N`, from 0 (fastest) to 9 (best)")
+	var storeExtensions stringList
+	flag.Var(&storeExtensions, "store-ext", "with -per-file-compress, store files whose names end in `EXT` (e.g. .iso) without trying to compress them, in addition to common compressed formats such as .jpg, .mp4, and .gz (may be repeated)")
+	perFileCompress := flag.Int64("per-file-compress", 0, "leave the archive uncompressed but gzip each backing file of at least `BYTES` individually, so that it can be fetched on its own")
+	shouldBeRsyncable := flag.Bool("rsyncable", false, "make gzip output rsync-friendly by compressing content-defined chunks independently")
+	shouldExtract := flag.Bool("extract", false, "extract the archive in FILE (or stdin) instead of creating one, or a delta archive given after its bases")
+	flag.BoolVar(shouldExtract, "x", false, "shorthand for -extract")
+	catPath := flag.String("cat", "", "write the contents of the file at `PATH` in the archive in FILE to stdout instead of creating an archive")
+	shouldSelfTest := flag.Bool("selftest", false, "check that this build of tarmac can archive and extract a small tree on this platform, and print PASS or FAIL")
+	hashOf := flag.String("hash-of", "", "print the backing store key of the contents of the file at `PATH` under -hash and -hash-bytes instead of creating an archive")
+	shouldVerify := flag.Bool("verify", false, "verify the integrity of the archive in FILE (or stdin) instead of creating one")
+	shouldRepair := flag.Bool("repair", false, "copy the archive in FILE to -output (or stdout), restoring missing backing files from the -source archives and directories")
+	var sources stringList
+	flag.Var(&sources, "source", "search the archive or directory at `PATH` for the contents of missing backing files (may be repeated)")
+	shouldList := flag.Bool("list", false, "list the logical contents of the archive in FILE (or stdin) instead of creating one")
+	shouldListLong := flag.Bool("long", false, "include the backing store key of each file in the output of -list")
+	shouldPreserveOwner := flag.Bool("preserve-owner", false, "when extracting as root, restore the owner and group of each entry, preferring the recorded names to the numeric IDs")
+	maxExtractBytes := flag.Int64("max-extract-bytes", 0, "when extracting, fail rather than write more than `BYTES` of file contents")
+	maxExtractFiles := flag.Int("max-extract-files", 0, "when extracting, fail rather than extract more than `N` entries")
+	extractDir := flag.String("C", ".", "extract into `DIR`")
+	outputPath := flag.String("output", "", "write the archive to `FILE` instead of stdout")
+	flag.StringVar(outputPath, "o", "", "shorthand for -output `FILE`")
+	prefix := flag.String("prefix", "", "archive the tree under `NAME` rather than the base name of its directory")
+	manifestPath := flag.String("manifest", "", "also write a JSON manifest of the archived entries and their hashes to `FILE`")
+	fromTar := flag.Bool("from-tar", false, "convert the tar archive in FILE (or stdin) into a deduplicated archive under -prefix instead of archiving a directory")
+	fromManifest := flag.String("from-manifest", "", "archive exactly the entries described by the JSON array of {path, source, mode, mtime} records in `FILE` (or stdin if FILE is -), in order, reading each from its source file, under the top-level directory of their paths or -prefix")
+	filesFrom := flag.String("files-from", "", "archive the paths listed one per line in `FILE` (or stdin if FILE is -) instead of a directory")
+	volumeSize := flag.Int64("split-size", 0, "write the archive given by -output as numbered volumes of at most `BYTES` each (FILE.000, FILE.001, ...), which read as one archive when FILE.000 is given")
+	diffPath := flag.String("diff", "", "compare the trees given as arguments with the archive `ARCHIVE`, hashing them as if archiving them, and print each path that was added, removed, or modified")
+	storeName := flag.String("store-name", tarmac.DefaultStoreName, "keep the backing store in a directory named `NAME` under the archive's root")
+	shouldSync := flag.Bool("fsync", false, "sync the archive given by -output or -append, and the directory that holds it, to stable storage before exiting")
+	blobsPath := flag.String("split", "", "write the backing store to `FILE` as a separate archive, leaving only the logical entries in the output (extract both with -x FILE OUTPUT)")
+	checksumPath := flag.String("checksum", "", "write the SHA-256 digest of the archive to `FILE` in the format used by sha256sum")
+	basePath := flag.String("base", "", "write a delta archive that refers to the contents already stored in `ARCHIVE` rather than storing them again")
+	maxTotal := flag.Int64("max-total", 0, "abandon the archive rather than write more than `BYTES` to the output, counted after compression")
+	appendPath := flag.String("append", "", "append to the existing uncompressed archive `ARCHIVE` instead of creating a new one")
+	hashAlgorithm := flag.String("hash", tarmac.DefaultHash, "derive backing file keys using `ALGORITHM` (sha256, sha512, or blake2b)")
+	verbose := flag.Bool("v", false, "log each backing file written and each entry skipped to stderr")
+	veryVerbose := flag.Bool("vv", false, "like -v, but also log each file hashed and each link written")
+	shouldShowProgress := flag.Bool("progress", false, "periodically print progress to stderr")
+	hashBytes := flag.Int("hash-bytes", 0, fmt.Sprintf("truncate hashes to `N` bytes (at least %d) to shorten backing file names, at the risk of collisions that would corrupt the archive", tarmac.MinHashBytes))
+	shouldPrintStats := flag.Bool("stats", false, "print deduplication statistics to stderr")
+	format := textFormat
+	flag.Var(&format, "format", "print the output of -list and -stats as `FORMAT` (text, json, or csv)")
+	var excludes stringList
+	flag.Var(&excludes, "exclude", "omit entries matching `PATTERN` (may be repeated)")
+	maxSize := flag.Int64("max-size", 0, "omit regular files larger than `BYTES`")
+	minSize := flag.Int64("min-size", 0, "omit regular files smaller than `BYTES`")
+	newerThan := flag.String("newer-than", "", "omit entries other than directories unless they were modified after `TIME` (RFC 3339, or @ followed by seconds since the epoch)")
+	shouldWarnCase := flag.Bool("warn-case-collisions", false, "warn about entries whose paths differ only in case, which would collide when extracted on a case-insensitive file system")
+	shouldFailCase := flag.Bool("fail-case-collisions", false, "like -warn-case-collisions, but fail rather than archive such entries (or skip them with -skip-errors)")
+	ignoreFile := flag.String("ignore-file", ".tarmacignore", "omit entries matching the patterns listed one per line in the file named `NAME` at the root of each archived tree, if there is one (disable with -ignore-file=)")
+	shouldUseGitIgnore := flag.Bool("gitignore", false, "omit entries that are ignored by .gitignore files in the archived tree")
+	shouldCanonicalizeModes := flag.Bool("canonical-modes", false, "record regular files as 0644 (or 0755 if executable) and directories as 0755, keeping any setuid, setgid, or sticky bits")
+	shouldStripSetuid := flag.Bool("strip-suid", false, "clear the setuid and setgid bits of every entry")
+	shouldSkipAtime := flag.Bool("noatime", false, "read files without updating their access times where permitted (Linux only)")
+	shouldBeFast := flag.Bool("fast", false, "archive directory entries in the order in which they are listed, reading the metadata of only those that are not excluded")
+	shouldStreamDirs := flag.Bool("stream-dirs", false, "read and archive directory entries in batches, in the order in which they are listed, rather than listing each directory in full first")
+	shouldBeReproducible := flag.Bool("reproducible", false, "produce identical archives from identical inputs by sorting entries and clearing timestamps and ownership")
+	shouldSkipDedup := flag.Bool("no-dedup", false, "write each file as a regular entry at its own path, producing a conventional tar archive without a backing store")
+	shouldLinkToFirst := flag.Bool("link-to-first", false, "write the first file with each content as a regular entry at its own path and later files with the same contents as hard links to it, producing a conventional tar archive without a backing store")
+	shouldChunk := flag.Bool("chunked", false, "split files into content-defined chunks and store each unique chunk once, so that files that share most of their contents share most of their storage")
+	shouldIndex := flag.Bool("index", false, "end the archive with an index that gives the offset and size within the uncompressed archive of the contents of each file, so that they can be read without reading the rest of the archive")
+	packSmall := flag.Int64("pack-small", 0, "pack the contents of files smaller than `BYTES` together into shared backing files rather than storing each in its own, saving the header and padding of each")
+	shouldSortStore := flag.Bool("sorted-store", false, "write each tree's new backing files in order of key, followed by its files in order of path, regardless of the order in which they are found")
+	jobs := flag.Int("jobs", runtime.NumCPU(), "hash up to `N` files concurrently")
+	maxOpenFiles := flag.Int("max-open-files", 0, "hold at most `N` files open for reading at once, waiting for others to be closed rather than failing (0 for half of the limit on open files, -1 for no limit)")
+	bufferThreshold := flag.Int64("buffer-threshold", tarmac.DefaultBufferThreshold, "hold files of up to `BYTES` in memory after hashing them rather than reading them twice")
+	mmapThreshold := flag.Int64("mmap", 0, "map files of at least `BYTES` into memory to hash and archive them rather than reading them through a buffer (Linux and macOS only)")
+	spillDir := flag.String("spill-dir", "", "copy larger files into temporary files in `DIR` while hashing them rather than reading them twice")
+	retries := flag.Int("retries", 0, "retry opening or reading a file up to `N` times after transient I/O errors, resuming where it failed")
+	retryDelay := flag.Duration("retry-delay", tarmac.DefaultRetryDelay, "wait `D` before the first retry of a file, doubling the delay for each further retry")
+	bufferSize := flag.Int("buffer-size", tarmac.DefaultBufferSize, "copy file contents using buffers of `BYTES`")
+	shouldSniff := flag.Bool("sniff", false, "detect the media type of each file from the first 512 bytes of its contents while hashing it, and record it in the archive and in the output of -manifest")
+	shouldKeepHardLinks := flag.Bool("hardlinks", false, "record which files are hard links to one another when creating an archive, and restore them as hard links when extracting one")
+	shouldUseFlags := flag.Bool("flags", false, "record file flags (e.g. immutable and append-only) when creating an archive, and restore them when extracting one")
+	shouldUseXattrs := flag.Bool("xattrs", false, "record extended attributes when creating an archive, and restore them when extracting one")
+	var owner, group identity
+	flag.Var(&owner, "owner", "record `NAME:UID` (or just UID) as the owner of every entry")
+	flag.Var(&group, "group", "record `NAME:GID` (or just GID) as the group of every entry")
+	uidMapPath := flag.String("uid-map", "", "record each UID listed in `FILE` as FROM:TO lines as the UID it maps to when creating an archive, and restore it as that UID with -preserve-owner when extracting one, in place of its recorded name (unlisted UIDs are unchanged)")
+	gidMapPath := flag.String("gid-map", "", "like -uid-map, but map the GIDs listed in `FILE`")
+	shouldDryRun := flag.Bool("dry-run", false, "walk and hash the tree without writing an archive (use with -stats to estimate its size)")
+	shouldSkipHashing := flag.Bool("no-hash", false, "with -dry-run, count files without reading them, assuming that their contents are unique")
+	shouldSkipErrors := flag.Bool("skip-errors", false, "warn about and skip unreadable files and directories rather than failing (exits with status 1 if any are skipped)")
+	shouldUsePAX := flag.Bool("pax", false, "write headers in the PAX format, preserving timestamps with nanosecond resolution")
+	var renameRules []tarmac.Rename
+	flag.Var(renames{rules: &renameRules}, "rename", "archive the entries whose paths relative to the root match the glob `FROM=TO` under TO instead, each * or ? in TO standing for the text matched by the corresponding wildcard in FROM (e.g. build/linux_amd64/*=bin/*), along with their contents (may be repeated; the first rule that matches applies)")
+	flag.Var(renames{rules: &renameRules, regexp: true}, "rename-regex", "like -rename, but `FROM=TO` gives a regular expression whose leftmost match is replaced by TO, in which $1 stands for the first submatch (may be repeated, and combined with -rename)")
+	strip := flag.Int("strip", 0, "remove the first `N` segments from the path of each entry, omitting entries with no segments left")
+	shouldDereference := flag.Bool("dereference", false, "archive the files that symlinks point to rather than the symlinks themselves")
+	shouldResolveRoot := flag.Bool("resolve-root", false, "archive each DIR that is a symlink under the name of the directory that it resolves to (by default, such a DIR is walked through the link and archived under the link's name)")
+	shouldFollowInternal := flag.Bool("follow-internal", false, "archive the files that symlinks point to if they are inside the archived tree, and other symlinks as symlinks")
+
+	env := readEnvironment()
+	flag.Parse()
+	if err := applyEnvironment(env); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(2)
+	}
+	uidMap, gidMap := openIDMap(*uidMapPath), openIDMap(*gidMapPath)
+	if *shouldSelfTest {
+		if err := selftest(); err != nil {
+			fmt.Printf("FAIL: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("PASS")
+		return
+	}
+
+	if *hashOf != "" {
+		key, err := hashFile(*hashOf, *hashAlgorithm, *hashBytes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(-1)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	if *shouldVerify {
+		input := openInput()
+		defer input.Close()
+
+		problems, err := tarmac.Verify(input)
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "Corrupt: %s\n", problem.Error())
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(-1)
+		}
+		if len(problems) != 0 {
+			fmt.Fprintf(os.Stderr, "Error: found %d problems\n", len(problems))
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *shouldRepair {
+		if flag.NArg() != 1 {
+			fmt.Fprintf(os.Stderr, "Error: -repair requires an archive file\n")
+			os.Exit(2)
+		}
+
+		problems, err := repair(flag.Arg(0), *outputPath, sources, compress, *level, *shouldBeRsyncable, *shouldSync)
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "Missing: %s\n", problem.Error())
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(-1)
+		}
+		if len(problems) != 0 {
+			fmt.Fprintf(os.Stderr, "Error: %d entries could not be repaired\n", len(problems))
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *catPath != "" {
+		input := openInput()
+		defer input.Close()
+
+		out := bufio.NewWriter(os.Stdout)
+		err := tarmac.Cat(input, *catPath, out)
+		if err == nil {
+			err = out.Flush()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(-1)
+		}
+		return
+	}
+
+	if *shouldList {
+		input := openInput()
+		defer input.Close()
+
+		err := list(input, os.Stdout, *shouldListLong, format)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(-1)
+		}
+		return
+	}
+
+	if *shouldExtract {
+		if (uidMap != nil || gidMap != nil) && !*shouldPreserveOwner {
+			fmt.Fprintf(os.Stderr, "Error: -uid-map and -gid-map require -preserve-owner when extracting\n")
+			os.Exit(2)
+		}
+		if *maxExtractBytes < 0 || *maxExtractFiles < 0 {
+			fmt.Fprintf(os.Stderr, "Error: -max-extract-bytes and -max-extract-files must not be negative\n")
+			os.Exit(2)
+		}
+
+		// A delta archive is extracted along with its bases, which are given first.
+		var inputs []io.Reader
+		if flag.NArg() > 1 {
+			for _, arg := range flag.Args() {
+				f, err := openArchiveFile(arg)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+					os.Exit(-1)
+				}
+				defer f.Close()
+				inputs = append(inputs, f)
+			}
+		} else {
+			input := openInput()
+			defer input.Close()
+			inputs = []io.Reader{input}
+		}
+
+		err := tarmac.ExtractAll(inputs, *extractDir, tarmac.ExtractOptions{
+			Xattrs:    *shouldUseXattrs,
+			Flags:     *shouldUseFlags,
+			SameOwner: *shouldPreserveOwner,
+			UIDMap:    uidMap,
+			GIDMap:    gidMap,
+			HardLinks: *shouldKeepHardLinks,
+			MaxBytes:  *maxExtractBytes,
+			MaxFiles:  *maxExtractFiles,
+			Warn:      warn,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(-1)
+		}
+		return
+	}
+
+	var tarInput io.Reader
+	switch {
+	case *fromManifest != "":
+		if *fromTar || *filesFrom != "" || flag.NArg() != 0 {
+			fmt.Fprintf(os.Stderr, "Error: -from-manifest cannot be combined with -from-tar, -files-from, or DIR\n")
+			os.Exit(2)
+		}
+		records, err := readSources(*fromManifest)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(-1)
+		}
+		sources, errs := newSourceArchive(records)
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		}
+		if len(errs) != 0 {
+			os.Exit(-1)
+		}
+		if *prefix == "" {
+			*prefix = sources.root
+		}
+		tarInput = sources.reader()
+	case *fromTar:
+		if *filesFrom != "" || *prefix == "" {
+			fmt.Fprintf(os.Stderr, "Error: -from-tar requires -prefix and cannot be combined with -files-from\n")
+			os.Exit(2)
+		}
+		input := openInput()
+		defer input.Close()
+		tarInput = input
+	case *filesFrom != "" && flag.NArg() != 0, *filesFrom == "" && flag.NArg() == 0:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *level != defaultLevel && (*level < 0 || *level > 9) {
+		fmt.Fprintf(os.Stderr, "Error: compression level %d is out of range (0-9)\n", *level)
+		os.Exit(2)
+	}
+	if *maxSize < 0 || *minSize < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -max-size and -min-size must not be negative\n")
+		os.Exit(2)
+	}
+	if *strip < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -strip must not be negative\n")
+		os.Exit(2)
+	}
+	var threshold time.Time
+	if *newerThan != "" {
+		var err error
+		threshold, err = parseTime(*newerThan)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -newer-than: %s\n", err.Error())
+			os.Exit(2)
+		}
+	}
+	if *retries < 0 || *retryDelay < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -retries and -retry-delay must not be negative\n")
+		os.Exit(2)
+	}
+	if *bufferSize <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: buffer size must be positive\n")
+		os.Exit(2)
+	}
+	if *appendPath != "" && (compress != "" || *outputPath != "" || *checksumPath != "" || *basePath != "" ||
+		*maxTotal != 0 || *blobsPath != "") {
+		fmt.Fprintf(os.Stderr, "Error: -append cannot be combined with -compress, -output, -checksum, -base, -max-total, or -split\n")
+		os.Exit(2)
+	}
+	if *maxTotal < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -max-total must not be negative\n")
+		os.Exit(2)
+	}
+	if *volumeSize < 0 || (*volumeSize != 0 && *outputPath == "") {
+		fmt.Fprintf(os.Stderr, "Error: -split-size must be positive and requires -output\n")
+		os.Exit(2)
+	}
+	if *prefix != "" {
+		*prefix = strings.Trim(path.Clean("/"+*prefix), "/")
+		if *prefix == "" {
+			fmt.Fprintf(os.Stderr, "Error: -prefix must name a directory\n")
+			os.Exit(2)
+		}
+	}
+	if (*shouldBeFast || *shouldStreamDirs) && *shouldBeReproducible {
+		fmt.Fprintf(os.Stderr, "Error: -fast and -stream-dirs cannot be combined with -reproducible\n")
+		os.Exit(2)
+	}
+	if *shouldKeepHardLinks && *shouldBeReproducible {
+		// Inode numbers differ between copies of the same tree.
+		fmt.Fprintf(os.Stderr, "Error: -hardlinks cannot be combined with -reproducible\n")
+		os.Exit(2)
+	}
+	if *shouldSkipHashing && !*shouldDryRun {
+		fmt.Fprintf(os.Stderr, "Error: -no-hash requires -dry-run\n")
+		os.Exit(2)
+	}
+	if *shouldSkipDedup && (*basePath != "" || *shouldSortStore || *perFileCompress != 0 || *blobsPath != "") {
+		fmt.Fprintf(os.Stderr, "Error: -no-dedup cannot be combined with -base, -sorted-store, -per-file-compress, or -split\n")
+		os.Exit(2)
+	}
+	if *shouldLinkToFirst && (*shouldSkipDedup || *shouldChunk || *shouldSortStore || *packSmall != 0 ||
+		*perFileCompress != 0 || *basePath != "" || *appendPath != "" || *blobsPath != "") {
+		fmt.Fprintf(os.Stderr, "Error: -link-to-first cannot be combined with -no-dedup, -chunked, -sorted-store, -pack-small, -per-file-compress, -base, -append, or -split\n")
+		os.Exit(2)
+	}
+	if *shouldChunk && (*shouldSkipDedup || *shouldSortStore || *perFileCompress != 0 || tarInput != nil) {
+		fmt.Fprintf(os.Stderr, "Error: -chunked cannot be combined with -no-dedup, -sorted-store, -per-file-compress, -from-tar, or -from-manifest\n")
+		os.Exit(2)
+	}
+	if *shouldIndex && (*shouldSkipDedup || *shouldLinkToFirst || compress != "" || *appendPath != "" ||
+		*blobsPath != "") {
+		fmt.Fprintf(os.Stderr, "Error: -index cannot be combined with -no-dedup, -link-to-first, -compress, -append, or -split\n")
+		os.Exit(2)
+	}
+	if *shouldSniff && *shouldSkipDedup {
+		fmt.Fprintf(os.Stderr, "Error: -sniff cannot be combined with -no-dedup\n")
+		os.Exit(2)
+	}
+	if *mmapThreshold < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -mmap must not be negative\n")
+		os.Exit(2)
+	}
+	if *packSmall < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -pack-small must not be negative\n")
+		os.Exit(2)
+	}
+	if *packSmall != 0 && (*shouldChunk || *shouldSkipDedup || *shouldSortStore) {
+		fmt.Fprintf(os.Stderr, "Error: -pack-small cannot be combined with -chunked, -no-dedup, or -sorted-store\n")
+		os.Exit(2)
+	}
+	if *perFileCompress < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -per-file-compress must not be negative\n")
+		os.Exit(2)
+	}
+	if len(storeExtensions) != 0 && *perFileCompress == 0 {
+		fmt.Fprintf(os.Stderr, "Error: -store-ext requires -per-file-compress\n")
+		os.Exit(2)
+	}
+	if *perFileCompress != 0 && compress != "" {
+		fmt.Fprintf(os.Stderr, "Error: -per-file-compress cannot be combined with -compress\n")
+		os.Exit(2)
+	}
+	if *shouldBeRsyncable && compress != "gzip" {
+		fmt.Fprintf(os.Stderr, "Error: -rsyncable requires gzip compression\n")
+		os.Exit(2)
+	}
+	if compress == "" && isFlagSet("level") {
+		fmt.Fprintf(os.Stderr, "Warning: -level has no effect without -compress\n")
+	}
+
+	var roots, names, files []string
+	if tarInput != nil {
+		// The entries are read from the archive or manifest rather than from a directory.
+	} else if *filesFrom != "" {
+		var err error
+		files, err = readFiles(*filesFrom)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(-1)
+		}
+
+		root := commonRoot(files)
+		if root == "" {
+			fmt.Fprintf(os.Stderr, "Error: %s lists no files\n", *filesFrom)
+			os.Exit(-1)
+		}
+		roots = []string{root}
+	} else {
+		// Each root is archived under its own name, so the names must be distinct.
+		seen := make(map[string]string)
+		for _, arg := range flag.Args() {
+			root, err := filepath.Abs(arg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+				os.Exit(-1)
+			}
+
+			// Only directories can be archived this way. Catch mistakes up front rather than failing partway through.
+			fi, err := os.Stat(root)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+				os.Exit(-1)
+			}
+			if !fi.IsDir() {
+				fmt.Fprintf(os.Stderr, "Error: %s is not a directory (use -files-from to archive individual files, or -x, -list, or -verify to read an archive)\n", arg)
+				os.Exit(2)
+			}
+
+			_, name := filepath.Split(root)
+			if *shouldResolveRoot {
+				root, err = filepath.EvalSymlinks(root)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+					os.Exit(-1)
+				}
+				_, name = filepath.Split(root)
+			}
+			if other, ok := seen[name]; ok {
+				fmt.Fprintf(os.Stderr, "Error: %s and %s would both be archived as %s\n", other, arg, name)
+				os.Exit(2)
+			}
+			seen[name] = arg
+
+			roots, names = append(roots, root), append(names, name)
+		}
+	}
+
+	// When appending, writing a delta, or comparing with an archive, the existing archive's hash algorithm is used
+	// unless one is given explicitly.
+	if (*appendPath != "" || *basePath != "" || *diffPath != "") && !isFlagSet("hash") {
+		*hashAlgorithm = ""
+	}
+
+	// Progress is only useful to someone watching, so avoid cluttering logs with it when the archive is written to
+	// stdout, which suggests that tarmac is part of a pipeline.
+	showProgress := *shouldShowProgress && (isTerminal(os.Stderr) || *outputPath != "" || *appendPath != "")
+
+	incompressible := append(append([]string(nil), tarmac.DefaultIncompressibleExtensions...), storeExtensions...)
+	c := &creation{
+		roots:        roots,
+		names:        names,
+		outputPath:   *outputPath,
+		appendPath:   *appendPath,
+		basePath:     *basePath,
+		prefix:       *prefix,
+		manifestPath: *manifestPath,
+		checksumPath: *checksumPath,
+		blobsPath:    *blobsPath,
+		volumeSize:   *volumeSize,
+		fsync:        *shouldSync,
+		files:        files,
+		tarInput:     tarInput,
+		progress:     showProgress,
+		compress:     compress,
+		level:        *level,
+		rsyncable:    *shouldBeRsyncable,
+		maxTotal:     *maxTotal,
+		stats:        *shouldPrintStats,
+		format:       format,
+		options: tarmac.Options{
+			Dereference:              *shouldDereference,
+			FollowInternal:           *shouldFollowInternal,
+			Hash:                     *hashAlgorithm,
+			HashBytes:                *hashBytes,
+			StoreName:                *storeName,
+			Exclude:                  excludes,
+			MaxSize:                  *maxSize,
+			MinSize:                  *minSize,
+			NewerThan:                threshold,
+			GitIgnore:                *shouldUseGitIgnore,
+			IgnoreFile:               *ignoreFile,
+			WarnCaseCollisions:       *shouldWarnCase,
+			FailCaseCollisions:       *shouldFailCase,
+			CanonicalModes:           *shouldCanonicalizeModes,
+			StripSetuid:              *shouldStripSetuid,
+			NoAtime:                  *shouldSkipAtime,
+			Fast:                     *shouldBeFast,
+			StreamDirs:               *shouldStreamDirs,
+			Reproducible:             *shouldBeReproducible,
+			NoDedup:                  *shouldSkipDedup,
+			LinkToFirst:              *shouldLinkToFirst,
+			SortedStore:              *shouldSortStore,
+			Chunked:                  *shouldChunk,
+			PackSmall:                *packSmall,
+			Index:                    *shouldIndex,
+			Jobs:                     *jobs,
+			MaxOpenFiles:             *maxOpenFiles,
+			BufferThreshold:          *bufferThreshold,
+			SpillDir:                 *spillDir,
+			MmapThreshold:            *mmapThreshold,
+			BufferSize:               *bufferSize,
+			Retries:                  *retries,
+			RetryDelay:               *retryDelay,
+			Warn:                     warn,
+			Xattrs:                   *shouldUseXattrs,
+			Flags:                    *shouldUseFlags,
+			HardLinks:                *shouldKeepHardLinks,
+			Sniff:                    *shouldSniff,
+			Owner:                    owner.Identity,
+			Group:                    group.Identity,
+			UIDMap:                   uidMap,
+			GIDMap:                   gidMap,
+			DryRun:                   *shouldDryRun,
+			SkipHashing:              *shouldSkipHashing,
+			SkipErrors:               *shouldSkipErrors,
+			PAX:                      *shouldUsePAX,
+			StripComponents:          *strip,
+			Renames:                  renameRules,
+			Compression:              string(compress),
+			CompressBacking:          *perFileCompress,
+			IncompressibleExtensions: incompressible,
+		},
+	}
+	// The files that are written are never archived, even if they lie within a tree.
+	c.options.ExcludeFiles = c.outputFiles()
+
+	if *verbose || *veryVerbose {
+		level := slog.LevelInfo
+		if *veryVerbose {
+			level = slog.LevelDebug
+		}
+
+		// Warnings are logged along with everything else rather than printed separately.
+		c.options.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+		c.options.Warn = nil
+	}
+
+	// The first Ctrl-C stops adding entries, leaving a valid archive of those that were written, and a second abandons
+	// the archive, removing any partially-written output. A diff is abandoned at once, as it would be incomplete.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	stop := make(chan struct{})
+	if *diffPath == "" {
+		c.stop = stop
+	}
+	go func() {
+		<-interrupts
+		if c.stop != nil {
+			fmt.Fprintf(os.Stderr, "Interrupted: finishing the entries in progress (interrupt again to abandon the archive)\n")
+			close(stop)
+			<-interrupts
+		}
+		cancel()
+	}()
+
+	if *diffPath != "" {
+		differences, err := c.diff(ctx, *diffPath, os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(-1)
+		}
+		if differences != 0 || c.skipped != 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	err := c.run(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			fmt.Fprintf(os.Stderr, "Error: interrupted\n")
+			os.Exit(130)
+		}
+		var limitErr *limitError
+		if errors.As(err, &limitErr) {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(3)
+		}
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(-1)
+	}
+	if c.stopped {
+		fmt.Fprintf(os.Stderr, "Warning: interrupted; the archive holds only the entries written before the interrupt\n")
+		os.Exit(4)
+	}
+	if c.skipped != 0 {
+		fmt.Fprintf(os.Stderr, "Warning: skipped %d unreadable entries\n", c.skipped)
+		os.Exit(1)
+	}
+}
+
+// openIDMap reads the map of user or group IDs in the named file given by -uid-map or -gid-map, exiting if it cannot
+// be read.
+func openIDMap(name string) map[int]int {
+	ids, err := readIDMap(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(-1)
+	}
+	return ids
+}
+
+// openInput opens the archive named by the command line's argument, or stdin if there is no argument or it is "-". It
+// exits if the archive cannot be opened. See openArchiveFile.
+func openInput() inputFile {
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if flag.NArg() == 0 || flag.Arg(0) == "-" {
+		return os.Stdin
+	}
+
+	f, err := openArchiveFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(-1)
+	}
+	return f
+}
+
+// hashFile returns the backing store key of the contents of the file at filePath.
+func hashFile(filePath, algorithm string, hashBytes int) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return tarmac.ContentKey(f, algorithm, hashBytes)
+}
+
+// warn prints a warning about an entry to stderr.
+func warn(archivePath string, err error) {
+	fmt.Fprintf(os.Stderr, "Warning: %s: %s\n", archivePath, err.Error())
+}
+
+// stringList is a flag.Value that collects the values of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// identity is a flag.Value that parses a user or group given as NAME:ID or ID.
+type identity struct {
+	*tarmac.Identity
+}
+
+func (i *identity) String() string {
+	if i.Identity == nil {
+		return ""
+	}
+	if i.Name == "" {
+		return strconv.Itoa(i.ID)
+	}
+	return i.Name + ":" + strconv.Itoa(i.ID)
+}
+
+func (i *identity) Set(value string) error {
+	name, id, ok := strings.Cut(value, ":")
+	if !ok {
+		name, id = "", value
+	}
+
+	n, err := strconv.Atoi(id)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid ID %q", id)
+	}
+
+	i.Identity = &tarmac.Identity{Name: name, ID: n}
+	return nil
+}
+
+// renames is a flag.Value that collects the rules given by -rename or -rename-regex as FROM=TO, in the order in which
+// they are given.
+type renames struct {
+	rules  *[]tarmac.Rename
+	regexp bool
+}
+
+func (r renames) String() string {
+	return ""
+}
+
+func (r renames) Set(value string) error {
+	from, to, ok := strings.Cut(value, "=")
+	if !ok || from == "" {
+		return fmt.Errorf("invalid rule %q: expected FROM=TO", value)
+	}
+
+	var rule tarmac.Rename
+	if r.regexp {
+		pattern, err := regexp.Compile(from)
+		if err != nil {
+			return err
+		}
+		rule = tarmac.Rename{Pattern: pattern, Replacement: to}
+	} else {
+		var err error
+		if rule, err = tarmac.GlobRename(from, to); err != nil {
+			return err
+		}
+	}
+	*r.rules = append(*r.rules, rule)
+	return nil
+}
+
+// isFlagSet returns true if the named flag was set on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// parseTime parses a time given in RFC 3339 format or as @ followed by a number of seconds since the Unix epoch, as
+// GNU date accepts.
+func parseTime(s string) (time.Time, error) {
+	if seconds, ok := strings.CutPrefix(s, "@"); ok {
+		n, err := strconv.ParseInt(seconds, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time %q", s)
+		}
+		return time.Unix(n, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain runs the command instead of the tests if TARMAC_TEST_MAIN is set, so that tests can run it as a subprocess.
+func TestMain(m *testing.M) {
+	if os.Getenv("TARMAC_TEST_MAIN") != "" {
+		os.Args = append([]string{"tarmac"}, os.Args[1:]...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runTarmac runs the command in dir with the given arguments, with env added to the environment, and returns its
+// combined output.
+func runTarmac(t *testing.T, dir string, env []string, args ...string) (string, error) {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), "TARMAC_TEST_MAIN=1"), env...)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// sourceTree creates a directory that holds a small tree to archive at src.
+func sourceTree(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "src", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "sub/b"} {
+		if err := os.WriteFile(filepath.Join(dir, "src", filepath.FromSlash(name)), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestCompressEnvironmentWithIndex(t *testing.T) {
+	dir := sourceTree(t)
+	if out, err := runTarmac(t, dir, []string{"TARMAC_COMPRESS=gzip"}, "-o", "y.tar", "-index", "src"); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if out, err := runTarmac(t, dir, nil, "-verify", "y.tar"); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+}
+
+func TestCompressEnvironmentWithAppend(t *testing.T) {
+	dir := sourceTree(t)
+	if out, err := runTarmac(t, dir, nil, "-o", "y.tar", "src"); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if out, err := runTarmac(t, dir, []string{"TARMAC_COMPRESS=gzip"}, "-append", "y.tar", "src/sub"); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if out, err := runTarmac(t, dir, nil, "-verify", "y.tar"); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+}
+
+func TestCompressEnvironmentWithPerFileCompress(t *testing.T) {
+	dir := sourceTree(t)
+	out, err := runTarmac(t, dir, []string{"TARMAC_COMPRESS=gzip"}, "-o", "y.tar", "-per-file-compress", "1", "src")
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+}
+
+func TestCompressEnvironment(t *testing.T) {
+	dir := sourceTree(t)
+	if out, err := runTarmac(t, dir, []string{"TARMAC_COMPRESS=gzip"}, "-o", "y.tar", "src"); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	archive, err := os.ReadFile(filepath.Join(dir, "y.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archive) < 2 || archive[0] != 0x1f || archive[1] != 0x8b {
+		t.Error("the archive is not gzipped")
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Time
+		ok   bool
+	}{
+		{"@1000000000", time.Unix(1000000000, 0), true},
+		{"2001-09-09T01:46:40Z", time.Unix(1000000000, 0), true},
+		{"2001-09-09T03:46:40+02:00", time.Unix(1000000000, 0), true},
+		{"@-1", time.Unix(-1, 0), true},
+		{"@1.5", time.Time{}, false},
+		{"2001-09-09", time.Time{}, false},
+	}
+	for _, test := range tests {
+		got, err := parseTime(test.s)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.s, err)
+		} else if test.ok && !got.Equal(test.want) {
+			t.Errorf("%s: got %v, want %v", test.s, got, test.want)
+		}
+	}
+}
+
+func TestNewerThanBoundary(t *testing.T) {
+	dir := sourceTree(t)
+	threshold := time.Unix(1000000000, 0)
+	times := map[string]time.Time{"a": threshold, "sub/b": threshold.Add(time.Second)}
+	for name, mtime := range times {
+		if err := os.Chtimes(filepath.Join(dir, "src", filepath.FromSlash(name)), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if out, err := runTarmac(t, dir, nil, "-o", "y.tar", "-newer-than", "@1000000000", "src"); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	out, err := runTarmac(t, dir, nil, "-list", "y.tar")
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if strings.Contains(out, "src/a") || !strings.Contains(out, "src/sub/b") {
+		t.Errorf("got listing %q, want src/sub/b without src/a", out)
+	}
+}
+
+func TestResolveRoot(t *testing.T) {
+	dir := sourceTree(t)
+	if err := os.Symlink("src", filepath.Join(dir, "current")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args        []string
+		root, other string
+	}{
+		{nil, "current", "src"},
+		{[]string{"-resolve-root"}, "src", "current"},
+	}
+	for _, test := range tests {
+		args := append(append([]string{"-o", "y.tar"}, test.args...), "current")
+		if out, err := runTarmac(t, dir, nil, args...); err != nil {
+			t.Fatalf("%v: %v: %s", args, err, out)
+		}
+		out, err := runTarmac(t, dir, nil, "-list", "y.tar")
+		if err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+		for _, name := range []string{"a", "sub/b"} {
+			if !strings.Contains(out, test.root+"/"+name) {
+				t.Errorf("%v: %s/%s is missing from the listing %q", test.args, test.root, name, out)
+			}
+		}
+		if strings.Contains(out, test.other+"/") {
+			t.Errorf("%v: the listing %q contains %s", test.args, out, test.other)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/pgavlin/tarmac"
+)
+
+// manifestRecord describes a logical entry in a manifest.
+type manifestRecord struct {
+	Path  string    `json:"path"`
+	Hash  string    `json:"hash,omitempty"`
+	Size  int64     `json:"size"`
+	Mode  string    `json:"mode"`
+	MTime time.Time `json:"mtime"`
+	Type  string    `json:"type,omitempty"`
+}
+
+// manifest writes a JSON array that describes the logical entries of an archive as they are added to it.
+type manifest struct {
+	w     io.Writer
+	count int
+	err   error
+}
+
+// add writes the record for an entry to the manifest. Errors are retained and reported by close.
+func (m *manifest) add(entry tarmac.Entry) {
+	if m.err != nil {
+		return
+	}
+
+	record, err := json.Marshal(manifestRecord{
+		Path:  entry.Header.Name,
+		Hash:  entry.Key,
+		Size:  entry.Header.Size,
+		Mode:  entry.Header.FileInfo().Mode().String(),
+		MTime: entry.Header.ModTime.UTC(),
+		Type:  entry.ContentType,
+	})
+	if err != nil {
+		m.err = err
+		return
+	}
+
+	separator := ",\n  "
+	if m.count == 0 {
+		separator = "[\n  "
+	}
+	m.count++
+
+	_, m.err = io.WriteString(m.w, separator+string(record))
+}
+
+// close terminates the manifest's array.
+func (m *manifest) close() error {
+	if m.err != nil {
+		return m.err
+	}
+
+	end := "\n]\n"
+	if m.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(m.w, end)
+	return err
+}
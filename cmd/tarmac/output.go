@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// outputFile is an archive destination on disk. The archive is written to a temporary file alongside the destination
+// that is only renamed into place once the archive is complete, so a failed run never leaves a truncated archive at
+// the destination path.
+type outputFile struct {
+	*os.File
+	path string
+
+	// durable is set if the file is flushed to stable storage when it is closed.
+	durable bool
+}
+
+func createOutput(path string) (*outputFile, error) {
+	f, err := os.OpenFile(tempPath(path), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	return &outputFile{File: f, path: path}, nil
+}
+
+// tempPath returns the path of the temporary file to which the output at path is written.
+func tempPath(path string) string {
+	return fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+}
+
+// Close closes the temporary file and renames it to the destination path. If the file is durable, its contents are
+// synced before it is renamed and its directory is synced after, so that the archive survives a crash that follows.
+func (f *outputFile) Close() error {
+	if f.durable {
+		if err := f.File.Sync(); err != nil {
+			return err
+		}
+	}
+
+	err := f.File.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(f.Name(), f.path)
+	if err != nil || !f.durable {
+		return err
+	}
+	return syncDir(filepath.Dir(f.path))
+}
+
+// Abort closes and removes the temporary file, leaving the destination path untouched.
+func (f *outputFile) Abort() {
+	f.File.Close()
+	os.Remove(f.Name())
+}
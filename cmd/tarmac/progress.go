@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pgavlin/tarmac"
+)
+
+// progressInterval is the interval at which progress is reported.
+const progressInterval = 250 * time.Millisecond
+
+// isTerminal returns true if f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// reportProgress periodically prints the progress of archive to stderr on a single line until the returned function
+// is called.
+func reportProgress(archive *tarmac.Writer) (stop func()) {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				printProgress(archive.Progress(), "")
+			case <-done:
+				printProgress(archive.Progress(), "\n")
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// printProgress overwrites the current line of stderr with a summary of p.
+func printProgress(p tarmac.Progress, end string) {
+	line := fmt.Sprintf("%d files, %s hashed", p.Files, formatBytes(p.Bytes))
+	if p.Path != "" && end == "" {
+		line += ": " + p.Path
+	}
+
+	// Clear the rest of the line in case the previous status was longer.
+	fmt.Fprintf(os.Stderr, "\r%s\x1b[K%s", line, end)
+}
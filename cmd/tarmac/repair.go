@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/pgavlin/tarmac"
+)
+
+// repair copies the archive at inputPath to the file at outputPath, or to stdout if outputPath is empty, restoring its
+// missing backing files from sources. If fsync is set, the output file is synced before it is closed. It returns the
+// links that could not be repaired.
+func repair(inputPath, outputPath string, sources []string, compress compression, level int, rsyncable,
+	fsync bool) (problems []*tarmac.VerifyError, err error) {
+	input, err := os.Open(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+
+	dest := io.WriteCloser(os.Stdout)
+	if outputPath != "" {
+		f, err := createOutput(outputPath)
+		if err != nil {
+			return nil, err
+		}
+		f.durable = fsync
+		defer func() {
+			if err != nil {
+				f.Abort()
+			}
+		}()
+		dest = f
+	}
+
+	output := dest
+	if compress != "" {
+		output, err = compressor(compress, level, rsyncable, dest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	problems, err = tarmac.Repair(input, output, sources, warn)
+	if err != nil {
+		return problems, err
+	}
+
+	if output != dest {
+		err = output.Close()
+		if err != nil {
+			return problems, err
+		}
+	}
+	return problems, dest.Close()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pgavlin/tarmac"
+)
+
+// selftest archives a small tree into memory, extracts it to another directory, and checks that the extracted tree is
+// equivalent to the original and that duplicate files were stored once.
+func selftest() error {
+	dir, err := os.MkdirTemp("", "tarmac-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	symlinks, err := writeSelftestTree(src)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	archive := tarmac.NewWriter(&buf, "src")
+	if err = archive.AddTree(src); err != nil {
+		return err
+	}
+	if err = archive.Close(); err != nil {
+		return err
+	}
+
+	problems, err := tarmac.Verify(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	if len(problems) != 0 {
+		return fmt.Errorf("the archive is corrupt: %v", problems[0])
+	}
+
+	// The three copies of the duplicated contents must share a backing file.
+	keys := make(map[string]bool)
+	err = tarmac.List(bytes.NewReader(buf.Bytes()), func(entry tarmac.Entry) error {
+		if entry.Key != "" {
+			keys[entry.Key] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(keys) != 2 {
+		return fmt.Errorf("expected 2 backing files, found %d", len(keys))
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if err = tarmac.Extract(bytes.NewReader(buf.Bytes()), dst); err != nil {
+		return err
+	}
+
+	want, err := describeTree(src)
+	if err != nil {
+		return err
+	}
+	got, err := describeTree(filepath.Join(dst, "src"))
+	if err != nil {
+		return err
+	}
+	for name, description := range want {
+		switch other, ok := got[name]; {
+		case !ok:
+			return fmt.Errorf("%s was not extracted", name)
+		case other != description:
+			return fmt.Errorf("%s was extracted as %s, not %s", name, other, description)
+		}
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			return fmt.Errorf("%s was extracted but not archived", name)
+		}
+	}
+
+	if !symlinks {
+		fmt.Fprintf(os.Stderr, "Warning: symlinks are not supported here, so they were not tested\n")
+	}
+	return nil
+}
+
+// writeSelftestTree creates the tree archived by selftest at root. It returns false if symlinks could not be created.
+func writeSelftestTree(root string) (bool, error) {
+	const duplicate = "the same contents, three times\n"
+	files := map[string]string{
+		"a.txt":                  duplicate,
+		"unique.txt":             "contents of their own\n",
+		"empty":                  "",
+		"nested/b.txt":           duplicate,
+		"nested/empty":           "",
+		"nested/deeper/c.txt":    duplicate,
+		"nested/empty-dir/.keep": "",
+	}
+	for name, contents := range files {
+		filePath := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return false, err
+		}
+		if err := os.WriteFile(filePath, []byte(contents), 0644); err != nil {
+			return false, err
+		}
+	}
+	if err := os.Remove(filepath.Join(root, "nested", "empty-dir", ".keep")); err != nil {
+		return false, err
+	}
+
+	if err := os.Symlink("a.txt", filepath.Join(root, "link")); err != nil {
+		return false, nil
+	}
+	if err := os.Symlink(filepath.Join("..", "missing"), filepath.Join(root, "nested", "dangling")); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// describeTree returns a description of the type, mode, modification time, and contents (or link target) of each
+// entry in the tree at root, by path relative to root.
+func describeTree(root string) (map[string]string, error) {
+	descriptions := make(map[string]string)
+	err := filepath.WalkDir(root, func(entryPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, entryPath)
+		if err != nil {
+			return err
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		// Symlink timestamps are not restored, and other timestamps are rounded to the nearest second.
+		description := fi.Mode().String()
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			description += " " + fi.ModTime().Round(time.Second).UTC().Format(time.RFC3339)
+		}
+
+		switch {
+		case fi.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(entryPath)
+			if err != nil {
+				return err
+			}
+			description += " -> " + target
+		case fi.Mode().IsRegular():
+			contents, err := os.ReadFile(entryPath)
+			if err != nil {
+				return err
+			}
+			description += fmt.Sprintf(" %q", contents)
+		}
+		descriptions[filepath.ToSlash(rel)] = description
+		return nil
+	})
+	return descriptions, err
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// syncDir flushes the directory at path to stable storage. Directories cannot be synced on other platforms, where
+// renaming a file is expected to be durable once the file itself is, so this does nothing.
+func syncDir(path string) error {
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import "os"
+
+// syncDir flushes the directory at path to stable storage, which makes the creation or renaming of the files in it
+// durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// volumePath returns the path of the volume with the given index of the archive at archivePath, e.g. archive.000.
+func volumePath(archivePath string, index int) string {
+	return fmt.Sprintf("%s.%03d", archivePath, index)
+}
+
+// volumeWriter is an archive destination that is split into numbered volumes of a fixed size, so that the archive can
+// be carried on media with a size limit and restored by concatenating the volumes in order. Like an outputFile, each
+// volume is written to a temporary file, and the volumes are renamed into place once the archive is complete.
+type volumeWriter struct {
+	path    string
+	size    int64
+	durable bool
+	volumes []*outputFile
+	written int64
+}
+
+// createVolumes creates the first volume of an archive at archivePath that is split into volumes of size bytes. If
+// durable is set, each volume is synced when it is closed, as is the directory that holds them.
+func createVolumes(archivePath string, size int64, durable bool) (*volumeWriter, error) {
+	w := &volumeWriter{path: archivePath, size: size, durable: durable}
+	if err := w.next(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// next closes the current volume, if any, and starts the next.
+func (w *volumeWriter) next() error {
+	if len(w.volumes) != 0 {
+		if err := w.closeCurrent(); err != nil {
+			return err
+		}
+	}
+
+	f, err := createOutput(volumePath(w.path, len(w.volumes)))
+	if err != nil {
+		return err
+	}
+	w.volumes, w.written = append(w.volumes, f), 0
+	return nil
+}
+
+func (w *volumeWriter) current() *outputFile {
+	return w.volumes[len(w.volumes)-1]
+}
+
+// closeCurrent closes the temporary file of the current volume, syncing it first if the volumes are durable.
+func (w *volumeWriter) closeCurrent() error {
+	f := w.current()
+	if w.durable {
+		if err := f.File.Sync(); err != nil {
+			return err
+		}
+	}
+	return f.File.Close()
+}
+
+func (w *volumeWriter) Write(b []byte) (int, error) {
+	total := 0
+	for len(b) > 0 {
+		if w.written == w.size {
+			if err := w.next(); err != nil {
+				return total, err
+			}
+		}
+
+		chunk := b
+		if remaining := w.size - w.written; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		n, err := w.current().Write(chunk)
+		total, w.written, b = total+n, w.written+int64(n), b[n:]
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Close closes the last volume and renames every volume into place.
+func (w *volumeWriter) Close() error {
+	if err := w.closeCurrent(); err != nil {
+		return err
+	}
+	for _, f := range w.volumes {
+		if err := os.Rename(f.Name(), f.path); err != nil {
+			return err
+		}
+	}
+	if w.durable {
+		return syncDir(filepath.Dir(w.path))
+	}
+	return nil
+}
+
+// Abort closes and removes the temporary files of every volume, leaving the destination paths untouched.
+func (w *volumeWriter) Abort() {
+	for _, f := range w.volumes {
+		f.Abort()
+	}
+}
+
+// inputFile is an archive that is read from stdin, a file, or a sequence of volumes.
+type inputFile interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// openArchiveFile opens the archive at archivePath. If archivePath names the first volume of an archive written with
+// -split-size (i.e. it ends in .000), the volumes that follow it are read after it as if they were one file.
+func openArchiveFile(archivePath string) (inputFile, error) {
+	f, err := os.Open(archivePath)
+	if err != nil || !strings.HasSuffix(archivePath, ".000") {
+		return f, err
+	}
+
+	base := strings.TrimSuffix(archivePath, ".000")
+	volumes := &volumeReader{}
+	for i := 0; ; i++ {
+		if i > 0 {
+			f, err = os.Open(volumePath(base, i))
+			if errors.Is(err, os.ErrNotExist) {
+				return volumes, nil
+			}
+			if err != nil {
+				volumes.Close()
+				return nil, err
+			}
+		}
+
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			volumes.Close()
+			return nil, err
+		}
+		volumes.files, volumes.sizes = append(volumes.files, f), append(volumes.sizes, fi.Size())
+	}
+}
+
+// volumeReader reads the concatenation of the volumes of an archive.
+type volumeReader struct {
+	files  []*os.File
+	sizes  []int64
+	offset int64
+}
+
+func (r *volumeReader) Read(b []byte) (int, error) {
+	offset := r.offset
+	for i, f := range r.files {
+		if offset >= r.sizes[i] {
+			offset -= r.sizes[i]
+			continue
+		}
+
+		if remaining := r.sizes[i] - offset; int64(len(b)) > remaining {
+			b = b[:remaining]
+		}
+		n, err := f.ReadAt(b, offset)
+		r.offset += int64(n)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+	return 0, io.EOF
+}
+
+func (r *volumeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		for _, size := range r.sizes {
+			offset += size
+		}
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *volumeReader) Close() error {
+	var err error
+	for _, f := range r.files {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,146 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The PAX records of a backing entry whose contents are individually compressed. See Options.CompressBacking.
+const (
+	encodingRecord = "TARMAC.encoding"
+	sizeRecord     = "TARMAC.size"
+)
+
+// contentSize returns the size of the contents of the regular file entry with the given header, which is recorded
+// separately if the contents are stored compressed.
+func contentSize(header *tar.Header) int64 {
+	if size, ok := header.PAXRecords[sizeRecord]; ok {
+		if n, err := strconv.ParseInt(size, 10, 64); err == nil {
+			return n
+		}
+	}
+	return header.Size
+}
+
+// contents returns a reader for the contents of the regular file entry with the given header, which are read from r,
+// decompressing them if they are stored compressed.
+func contents(header *tar.Header, r io.Reader) (io.Reader, error) {
+	switch encoding := header.PAXRecords[encodingRecord]; encoding {
+	case "":
+		return r, nil
+	case "gzip":
+		return gzip.NewReader(r)
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+}
+
+// isIncompressible returns true if the file at entryPath has one of Options.IncompressibleExtensions, and so is not
+// worth compressing.
+func (w *Writer) isIncompressible(entryPath string) bool {
+	ext := filepath.Ext(entryPath)
+	for _, incompressible := range w.options.IncompressibleExtensions {
+		if strings.EqualFold(ext, incompressible) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCompressed writes the backing entry for a regular file with its contents compressed with gzip, recording their
+// original size in a PAX record. The contents are compressed to a temporary file first, as an entry's size must be
+// known before its header is written. writeCompressed writes nothing and returns false if compression would not make
+// the contents smaller.
+func (w *Writer) writeCompressed(entryPath string, header *tar.Header, hash *fileHash) (bool, error) {
+	src, err := w.openContents(entryPath, hash)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+
+	f, err := os.CreateTemp(w.spillDir, "gzip")
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	compressor := gzip.NewWriter(f)
+	_, err = w.copy(compressor, src)
+	if err != nil {
+		return false, err
+	}
+	err = compressor.Close()
+	if err != nil {
+		return false, err
+	}
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil || size >= header.Size {
+		return false, err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	header.PAXRecords[encodingRecord] = "gzip"
+	header.PAXRecords[sizeRecord] = strconv.FormatInt(header.Size, 10)
+	header.Size = size
+
+	err = w.writeHeader(header)
+	if err != nil {
+		return false, err
+	}
+
+	archive, _ := w.target(header.Name)
+	_, err = w.copy(archive, f)
+	return true, err
+}
+
+// writeHooked writes the backing entry with the given key and header with the contents returned by
+// Options.BackingHook for the contents in src. The hook's contents are copied to a temporary file first, as they may
+// differ in size from the original contents and an entry's size must be known before its header is written.
+func (w *Writer) writeHooked(key string, header *tar.Header, src io.Reader) error {
+	r, err := w.options.BackingHook(key, header.Size, src)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(w.spillDir, "hook")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	size, err := w.copy(f, r)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header.Size = size
+
+	err = w.writeHeader(header)
+	if err != nil {
+		return err
+	}
+
+	archive, _ := w.target(header.Name)
+	_, err = w.copy(archive, f)
+	return err
+}
@@ -0,0 +1,650 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// ExtractOptions controls how an archive is extracted.
+type ExtractOptions struct {
+	// Xattrs causes extended attributes recorded as SCHILY.xattr PAX records to be applied to the extracted entries.
+	Xattrs bool
+
+	// Flags causes file flags recorded as SCHILY.fflags PAX records to be applied to the extracted regular files and
+	// directories. They are applied once every entry has been extracted, as flags such as immutable would prevent the
+	// entry (or, for a directory, its children) from being changed further. Setting some flags requires privileges;
+	// flags that cannot be set are reported to Warn.
+	Flags bool
+
+	// SameOwner causes the owner and group of each extracted entry to be set to those recorded in the archive, as GNU
+	// tar's --same-owner does. The recorded names are preferred to the numeric IDs if they exist on this system. Owners
+	// are only set if the extractor is running as root; otherwise the option is ignored.
+	SameOwner bool
+
+	// UIDMap and GIDMap, if non-nil, map the user and group IDs recorded in the archive to the local IDs that SameOwner
+	// sets, e.g. to restore an archive from a system whose accounts are numbered differently. The IDs that they map
+	// are used in place of the recorded names; other IDs are resolved as usual.
+	UIDMap, GIDMap map[int]int
+
+	// MaxBytes and MaxFiles, if non-zero, limit the total size of the contents that are written and the number of
+	// entries that are extracted, which guards against archives that expand far beyond their own size. Extraction
+	// fails once either limit is exceeded. An entry whose header declares more contents than remain within MaxBytes is
+	// rejected before any of them are written.
+	MaxBytes int64
+	MaxFiles int
+
+	// HardLinks causes regular files whose entries record the same source inode (see Options.HardLinks) to be
+	// extracted as hard links to the first of them, recreating the hard links of the source tree independently of
+	// the links to the backing store.
+	HardLinks bool
+
+	// Warn, if non-nil, is called for each entry that is skipped (e.g. device nodes on platforms that do not support
+	// them) or whose metadata could not be fully restored. Calls to Warn are not concurrent.
+	Warn func(archivePath string, err error)
+}
+
+type extractionContext struct {
+	root    string
+	stores  map[string]bool
+	dirs    []*tar.Header
+	options ExtractOptions
+
+	// The local IDs of the user and group names seen so far, or -1 for names that do not exist on this system.
+	uids, gids map[string]int
+
+	// The archive paths of the entries extracted so far, and the number of entries and bytes of contents that count
+	// against the limits in options.
+	entries map[string]bool
+	files   int
+	written int64
+
+	// The archive paths of the first files extracted for each recorded source inode. See ExtractOptions.HardLinks.
+	inodes map[string]string
+
+	// The extracted entries whose file flags are applied by finish. See ExtractOptions.Flags.
+	flagged []*tar.Header
+
+	// The backing stores named by the archives' global headers.
+	known storeSet
+}
+
+// admit checks that the entry with the given header may be extracted: it must not exceed the limits in
+// ExtractOptions, and a backing file must not replace one that was already extracted, which would change the contents
+// of the files that are linked to it.
+func (ctx *extractionContext) admit(header *tar.Header) error {
+	ctx.files++
+	if max := ctx.options.MaxFiles; max > 0 && ctx.files > max {
+		return fmt.Errorf("the archive has more than %d entries", max)
+	}
+
+	if max := ctx.options.MaxBytes; max > 0 && header.Typeflag == tar.TypeReg {
+		if size := contentSize(header); size > max-ctx.written {
+			return fmt.Errorf("the entry's %d bytes would exceed the limit of %d bytes", size, max)
+		}
+	}
+
+	if name := path.Clean(header.Name); ctx.known.contains(name) && ctx.entries[name] {
+		return errors.New("the backing file appears more than once")
+	}
+	return nil
+}
+
+// limitedReader counts the bytes read from an underlying reader against ExtractOptions.MaxBytes.
+type limitedReader struct {
+	ctx *extractionContext
+	r   io.Reader
+}
+
+func (r *limitedReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.ctx.written += int64(n)
+	if max := r.ctx.options.MaxBytes; max > 0 && r.ctx.written > max {
+		return n, fmt.Errorf("the archive's contents exceed the limit of %d bytes", max)
+	}
+	return n, err
+}
+
+// errSpecialUnsupported is returned by mknod on platforms that cannot create device nodes or FIFOs.
+var errSpecialUnsupported = errors.New("skipping device node or FIFO, which are not supported on this platform")
+
+// The magic numbers that begin compressed streams.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// magicSize is the number of bytes needed to identify a compressed stream.
+const magicSize = 10
+
+// compressionOf returns the compression format of the stream that begins with magic, or "" if it is not compressed.
+func compressionOf(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return "gzip"
+	case bytes.HasPrefix(magic, zstdMagic):
+		return "zstd"
+	case bytes.HasPrefix(magic, xzMagic):
+		return "xz"
+	case len(magic) >= 10 && string(magic[:3]) == "BZh" && '1' <= magic[3] && magic[3] <= '9' &&
+		string(magic[4:10]) == "1AY&SY":
+		// A bzip2 header is followed by the magic number of the first block. Checking it avoids mistaking a tar
+		// stream whose first entry begins with "BZh" for bzip2.
+		return "bzip2"
+	}
+	return ""
+}
+
+// openArchive returns a reader for the tar stream in r, transparently decompressing it if it is gzip-, zstd-, bzip2-,
+// or xz-compressed.
+func openArchive(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	magic, _ := br.Peek(magicSize)
+	switch compressionOf(magic) {
+	case "gzip":
+		return gzip.NewReader(br)
+	case "zstd":
+		decoder, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case "bzip2":
+		return bzip2.NewReader(br), nil
+	case "xz":
+		return xz.NewReader(br)
+	}
+
+	return br, nil
+}
+
+// resolve returns the on-disk path for the given archive path, refusing paths that would escape the destination
+// directory.
+func (ctx *extractionContext) resolve(archivePath string) (string, error) {
+	if path.IsAbs(archivePath) || filepath.IsAbs(archivePath) {
+		return "", fmt.Errorf("refusing to extract absolute path %q", archivePath)
+	}
+
+	cleaned := path.Clean(archivePath)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("refusing to extract %q outside of the destination directory", archivePath)
+	}
+
+	target := filepath.Join(ctx.root, filepath.FromSlash(cleaned))
+
+	// Check the joined path as well, as archive paths may contain characters that are separators on this platform but
+	// not in the archive (e.g. backslashes on Windows).
+	if rel, err := filepath.Rel(ctx.root, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("refusing to extract %q outside of the destination directory", archivePath)
+	}
+
+	// Refuse to follow symlinks created by earlier entries, as they may point outside of the destination directory.
+	for dir := filepath.Dir(target); len(dir) > len(ctx.root); dir = filepath.Dir(dir) {
+		fi, err := os.Lstat(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to extract %q through a symlink", archivePath)
+		}
+	}
+
+	return target, nil
+}
+
+func (ctx *extractionContext) extractDir(target string, header *tar.Header) error {
+	// Refuse to replace a symlink with a directory, as its metadata would otherwise be applied to whatever the symlink
+	// points to.
+	if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("refusing to extract directory %q over a symlink", header.Name)
+	}
+
+	err := os.MkdirAll(target, 0700)
+	if err != nil {
+		return err
+	}
+
+	// Directory metadata is applied once all entries have been extracted, as creating entries inside the directory
+	// would otherwise clobber its mtime (and a read-only mode would prevent their creation).
+	ctx.dirs = append(ctx.dirs, header)
+	return nil
+}
+
+func (ctx *extractionContext) extractFile(target string, header *tar.Header, contents io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	// Remove whatever other than a regular file is in the way, rather than writing through it: it may be a symlink
+	// that points outside of the destination directory.
+	if fi, err := os.Lstat(target); err == nil && !fi.Mode().IsRegular() {
+		if err = os.Remove(target); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|noFollow, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, &limitedReader{ctx: ctx, r: contents})
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	// Changing the owner clears the setuid and setgid bits, so it must precede applying the mode.
+	err = ctx.chown(target, header)
+	if err != nil {
+		return err
+	}
+	return applyMetadata(target, header)
+}
+
+func (ctx *extractionContext) extractLink(target string, header *tar.Header) error {
+	// Only entries that were extracted from the archive may be linked to, rather than whatever happens to be in the
+	// destination directory.
+	if !ctx.entries[path.Clean(header.Linkname)] {
+		return fmt.Errorf("dangling link to %s", header.Linkname)
+	}
+
+	linkTarget, err := ctx.resolve(header.Linkname)
+	if err != nil {
+		return err
+	}
+
+	// Remember the backing stores that are referenced so that they can be cleaned up once extraction is complete.
+	if backingDir := path.Dir(path.Clean(header.Linkname)); ctx.known.isStore(backingDir) {
+		ctx.stores[backingDir] = true
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Archives written by earlier versions link empty files to a shared backing file. Create them independently, so
+	// that they are not hard linked to one another.
+	if fi, err := os.Lstat(linkTarget); err == nil && fi.Mode().IsRegular() && fi.Size() == 0 &&
+		ctx.known.contains(header.Linkname) {
+		return ctx.extractFile(target, header, strings.NewReader(""))
+	}
+
+	if os.Link(linkTarget, target) == nil {
+		return nil
+	}
+
+	// Hard links are unavailable (e.g. the target filesystem does not support them): fall back to copying the contents
+	// of the link target.
+	src, err := openExtracted(linkTarget)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return ctx.extractFile(target, header, src)
+}
+
+// openExtracted opens the extracted regular file at target for reading. Symlinks are not followed, as they may point
+// outside of the destination directory.
+func openExtracted(target string) (*os.File, error) {
+	fi, err := os.Lstat(target)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("refusing to read %s, which is not a regular file", target)
+	}
+	return os.OpenFile(target, os.O_RDONLY|noFollow, 0)
+}
+
+func (ctx *extractionContext) extractSymlink(target string, header *tar.Header) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = os.Symlink(filepath.FromSlash(header.Linkname), target)
+	if err != nil {
+		return err
+	}
+	return ctx.chown(target, header)
+}
+
+func (ctx *extractionContext) extractSpecial(target string, header *tar.Header) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = mknod(target, header)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.chown(target, header)
+	if err != nil {
+		return err
+	}
+	return applyMetadata(target, header)
+}
+
+func (ctx *extractionContext) warn(archivePath string, err error) {
+	if ctx.options.Warn != nil {
+		ctx.options.Warn(archivePath, err)
+	}
+}
+
+// chown sets the owner and group of the entry at target to those recorded in header, as mapped by ExtractOptions.UIDMap
+// and GIDMap. See ExtractOptions.SameOwner.
+func (ctx *extractionContext) chown(target string, header *tar.Header) error {
+	if !ctx.options.SameOwner || os.Geteuid() != 0 {
+		return nil
+	}
+
+	uid, ok := ctx.options.UIDMap[header.Uid]
+	if !ok {
+		uid = lookupID(ctx.uids, header.Uname, header.Uid, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+	}
+	gid, ok := ctx.options.GIDMap[header.Gid]
+	if !ok {
+		gid = lookupID(ctx.gids, header.Gname, header.Gid, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+	}
+	return os.Lchown(target, uid, gid)
+}
+
+// lookupID returns the local ID of the user or group with the given name, or id if the name is empty or does not
+// exist on this system. The IDs of names are cached in ids.
+func lookupID(ids map[string]int, name string, id int, lookup func(name string) (string, error)) int {
+	if name == "" {
+		return id
+	}
+
+	local, ok := ids[name]
+	if !ok {
+		local = -1
+		if s, err := lookup(name); err == nil {
+			if n, err := strconv.Atoi(s); err == nil {
+				local = n
+			}
+		}
+		ids[name] = local
+	}
+
+	if local < 0 {
+		return id
+	}
+	return local
+}
+
+func applyMetadata(target string, header *tar.Header) error {
+	err := os.Chmod(target, header.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+	if err != nil {
+		return err
+	}
+
+	// Archives written in the PAX format may record access times as well.
+	atime := header.AccessTime
+	if atime.IsZero() {
+		atime = time.Now()
+	}
+	return os.Chtimes(target, atime, header.ModTime)
+}
+
+// extract extracts the entries of the archive in input. Once every archive has been extracted, finish must be called.
+func (ctx *extractionContext) extract(input io.Reader) error {
+	archive := tar.NewReader(input)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			ctx.known.observe(header)
+			continue
+		}
+		if isIndex(header, ctx.known) {
+			continue
+		}
+
+		target, err := ctx.resolve(header.Name)
+		if err != nil {
+			return err
+		}
+		if err = ctx.admit(header); err != nil {
+			return fmt.Errorf("%s: %v", header.Name, err)
+		}
+
+		inode, hasInode := recordedInode(header)
+		hasInode = hasInode && ctx.options.HardLinks
+		if first, ok := ctx.inodes[inode]; hasInode && ok {
+			// The file shared an inode with one that was already extracted, so it is linked to that file rather than
+			// extracted from its own entry.
+			link := *header
+			link.Typeflag, link.Linkname = tar.TypeLink, first
+			header = &link
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = ctx.extractDir(target, header)
+		case tar.TypeReg:
+			if isChunked(header) {
+				err = ctx.extractChunked(target, header, archive)
+				break
+			}
+
+			var r io.Reader
+			r, err = contents(header, archive)
+			if err == nil {
+				err = ctx.extractFile(target, header, r)
+			}
+		case tar.TypeLink:
+			err = ctx.extractLink(target, header)
+		case tar.TypeSymlink:
+			err = ctx.extractSymlink(target, header)
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			err = ctx.extractSpecial(target, header)
+			if err == errSpecialUnsupported {
+				ctx.warn(header.Name, err)
+				continue
+			}
+		default:
+			err = errors.New("unsupported entry type")
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", header.Name, err)
+		}
+		ctx.entries[path.Clean(header.Name)] = true
+		if _, ok := ctx.inodes[inode]; hasInode && !ok {
+			ctx.inodes[inode] = path.Clean(header.Name)
+		}
+
+		if ctx.options.Xattrs {
+			err = writeXattrs(target, header.PAXRecords)
+			if err != nil {
+				ctx.warn(header.Name, err)
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeLink, tar.TypeDir:
+			if ctx.options.Flags && header.PAXRecords[flagsRecord] != "" {
+				ctx.flagged = append(ctx.flagged, header)
+			}
+		}
+	}
+
+	return nil
+}
+
+// finish removes the backing stores and applies the metadata of the extracted directories.
+func (ctx *extractionContext) finish() error {
+	// The logical files now share the backing files' contents, so the backing stores themselves are no longer needed.
+	// They are removed first, as removing them would otherwise clobber the mtime of their parent directories (and a
+	// read-only mode would prevent their removal).
+	for store := range ctx.stores {
+		target, err := ctx.resolve(store)
+		if err != nil {
+			return err
+		}
+
+		err = os.RemoveAll(target)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Apply directory metadata in reverse order so that children are finished before their parents. A directory that
+	// appears in several archives takes its metadata from the last.
+	applied := make(map[string]bool)
+	for i := len(ctx.dirs) - 1; i >= 0; i-- {
+		header := ctx.dirs[i]
+		name := path.Clean(header.Name)
+		if applied[name] || ctx.stores[name] {
+			continue
+		}
+		applied[name] = true
+
+		target, err := ctx.resolve(header.Name)
+		if err != nil {
+			return err
+		}
+
+		// A later entry may have replaced the directory (e.g. with a symlink), to which its metadata does not apply.
+		if fi, err := os.Lstat(target); err != nil || !fi.IsDir() {
+			continue
+		}
+
+		err = ctx.chown(target, header)
+		if err != nil {
+			return err
+		}
+		err = applyMetadata(target, header)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Apply file flags last, children before their parents, as they may prevent any further changes.
+	for i := len(ctx.flagged) - 1; i >= 0; i-- {
+		header := ctx.flagged[i]
+		target, err := ctx.resolve(header.Name)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Lstat(target); err != nil || fi.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		if err = writeFlags(target, header.PAXRecords[flagsRecord]); err != nil {
+			ctx.warn(header.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Extract reads a tarmac archive from r and restores its logical contents under the directory at destPath. Hard link
+// entries that refer to backing files are restored as hard links to (or, where hard links are unavailable, copies of)
+// the extracted backing files, and the backing stores are removed once extraction is complete. Compressed archives
+// are detected and decompressed transparently. Entries that would be written outside of destPath are rejected.
+func Extract(r io.Reader, destPath string) error {
+	return ExtractWithOptions(r, destPath, ExtractOptions{})
+}
+
+// ExtractWithOptions is like Extract, but uses the given options.
+func ExtractWithOptions(r io.Reader, destPath string, options ExtractOptions) error {
+	return ExtractAll([]io.Reader{r}, destPath, options)
+}
+
+// ExtractAll is like ExtractWithOptions, but extracts each of the given archives in turn as if they were a single
+// archive, so that later archives may refer to the backing files of earlier ones. This allows a delta archive to be
+// extracted along with its base (see Writer.AddBase). The backing stores are removed once every archive has been
+// extracted.
+func ExtractAll(archives []io.Reader, destPath string, options ExtractOptions) error {
+	root, err := filepath.Abs(destPath)
+	if err != nil {
+		return err
+	}
+
+	ctx := &extractionContext{
+		root:    root,
+		stores:  make(map[string]bool),
+		options: options,
+		uids:    make(map[string]int),
+		gids:    make(map[string]int),
+		entries: make(map[string]bool),
+		inodes:  make(map[string]string),
+		known:   make(storeSet),
+	}
+	for _, r := range archives {
+		input, err := openArchive(r)
+		if err != nil {
+			return err
+		}
+
+		err = ctx.extract(input)
+		if err != nil {
+			return err
+		}
+	}
+	return ctx.finish()
+}
@@ -0,0 +1,24 @@
+//go:build freebsd
+
+package tarmac
+
+import (
+	"archive/tar"
+
+	"golang.org/x/sys/unix"
+)
+
+// mknod creates the device node or FIFO described by header at target.
+func mknod(target string, header *tar.Header) error {
+	mode := uint32(header.Mode & 07777)
+	switch header.Typeflag {
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+	case tar.TypeFifo:
+		mode |= unix.S_IFIFO
+	}
+
+	return unix.Mknod(target, mode, unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor)))
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package tarmac
+
+import "archive/tar"
+
+// mknod creates the device node or FIFO described by header at target. Device nodes and FIFOs are not supported on
+// this platform, so such entries are skipped.
+func mknod(target string, header *tar.Header) error {
+	return errSpecialUnsupported
+}
@@ -0,0 +1,180 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// rawArchive writes an uncompressed tar archive of the given headers, each regular file containing its name.
+func rawArchive(t *testing.T, headers ...*tar.Header) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, header := range headers {
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(header.Name))
+		}
+		if header.ModTime.IsZero() {
+			header.ModTime = time.Unix(0, 0)
+		}
+		if err := w.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := w.Write([]byte(header.Name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// outsideFile creates a file outside of the destination directory that extraction must not touch.
+func outsideFile(t *testing.T) (string, []byte) {
+	t.Helper()
+
+	contents := []byte("outside")
+	name := filepath.Join(t.TempDir(), "outside")
+	if err := os.WriteFile(name, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name, contents
+}
+
+func checkUntouched(t *testing.T, name string, contents []byte) {
+	t.Helper()
+
+	got, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Fatalf("%s was overwritten: %q", name, got)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0644 {
+		t.Fatalf("the mode of %s was changed to %v", name, fi.Mode().Perm())
+	}
+}
+
+// checkRegular fails the test unless the entry at name is a regular file.
+func checkRegular(t *testing.T, name string) {
+	t.Helper()
+
+	fi, err := os.Lstat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.Mode().IsRegular() {
+		t.Fatalf("%s is not a regular file: %v", name, fi.Mode())
+	}
+}
+
+func TestExtractFileOverExistingSymlink(t *testing.T) {
+	outside, contents := outsideFile(t)
+	dest := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dest, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := rawArchive(t, &tar.Header{Name: "a", Typeflag: tar.TypeReg, Mode: 0600})
+	if err := Extract(bytes.NewReader(archive), dest); err != nil {
+		t.Fatal(err)
+	}
+	checkUntouched(t, outside, contents)
+	checkRegular(t, filepath.Join(dest, "a"))
+}
+
+func TestExtractFileOverSymlink(t *testing.T) {
+	outside, contents := outsideFile(t)
+	archive := rawArchive(t,
+		&tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside},
+		&tar.Header{Name: "a", Typeflag: tar.TypeReg, Mode: 0600},
+	)
+
+	dest := t.TempDir()
+	if err := Extract(bytes.NewReader(archive), dest); err != nil {
+		t.Fatal(err)
+	}
+	checkUntouched(t, outside, contents)
+	checkRegular(t, filepath.Join(dest, "a"))
+}
+
+func TestExtractDirOverExistingSymlink(t *testing.T) {
+	outside, contents := outsideFile(t)
+	dest := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dest, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := rawArchive(t, &tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0777})
+	if err := Extract(bytes.NewReader(archive), dest); err == nil {
+		t.Fatal("expected an error")
+	}
+	checkUntouched(t, outside, contents)
+}
+
+func TestExtractDirOverSymlink(t *testing.T) {
+	outside, contents := outsideFile(t)
+	archive := rawArchive(t,
+		&tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside},
+		&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0777},
+	)
+
+	if err := Extract(bytes.NewReader(archive), t.TempDir()); err == nil {
+		t.Fatal("expected an error")
+	}
+	checkUntouched(t, outside, contents)
+}
+
+func TestExtractDirReplacedBySymlink(t *testing.T) {
+	outside, contents := outsideFile(t)
+	archive := rawArchive(t,
+		&tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0777},
+		&tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside},
+	)
+
+	if err := Extract(bytes.NewReader(archive), t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	checkUntouched(t, outside, contents)
+}
+
+func TestExtractLinkToSymlink(t *testing.T) {
+	outside, contents := outsideFile(t)
+	archive := rawArchive(t,
+		&tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside},
+		&tar.Header{Name: "b", Typeflag: tar.TypeLink, Linkname: "a"},
+		&tar.Header{Name: "b", Typeflag: tar.TypeReg, Mode: 0600},
+	)
+
+	dest := t.TempDir()
+	if err := Extract(bytes.NewReader(archive), dest); err != nil {
+		t.Fatal(err)
+	}
+	checkUntouched(t, outside, contents)
+	checkRegular(t, filepath.Join(dest, "b"))
+}
+
+func TestOpenExtractedSymlink(t *testing.T) {
+	outside, _ := outsideFile(t)
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := openExtracted(link); err == nil {
+		f.Close()
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,50 @@
+package tarmac
+
+import (
+	"fmt"
+	"strings"
+)
+
+// flagsRecord is the PAX record that holds an entry's file flags as a comma-separated list of names, following the
+// convention used by libarchive. See Options.Flags.
+const flagsRecord = "SCHILY.fflags"
+
+// fileFlag names a file flag supported by this platform.
+type fileFlag struct {
+	name string
+	bit  uint32
+}
+
+// formatFlags returns the names of the flags in table that are set in bits, in the order of the table. A bit that more
+// than one name maps to is named by the first.
+func formatFlags(table []fileFlag, bits uint32) string {
+	var names []string
+	for _, flag := range table {
+		if bits&flag.bit != 0 {
+			names = append(names, flag.name)
+			bits &^= flag.bit
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// parseFlags returns the bits of the flags named in the comma-separated list s, and the bits of every flag in table.
+func parseFlags(table []fileFlag, s string) (bits, known uint32, err error) {
+	for _, flag := range table {
+		known |= flag.bit
+	}
+
+	for _, name := range strings.Split(s, ",") {
+		found := false
+		for _, flag := range table {
+			if flag.name == name {
+				bits |= flag.bit
+				found = true
+			}
+		}
+		if !found {
+			return 0, 0, fmt.Errorf("file flag %q is not supported on this platform", name)
+		}
+	}
+	return bits, known, nil
+}
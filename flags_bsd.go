@@ -0,0 +1,41 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package tarmac
+
+import "golang.org/x/sys/unix"
+
+// bsdFlags are the file flags that are recorded and restored, by the names that chflags(1) uses for them.
+var bsdFlags = []fileFlag{
+	{"nodump", 0x1},     // UF_NODUMP
+	{"uchg", 0x2},       // UF_IMMUTABLE
+	{"uappnd", 0x4},     // UF_APPEND
+	{"opaque", 0x8},     // UF_OPAQUE
+	{"arch", 0x10000},   // SF_ARCHIVED
+	{"schg", 0x20000},   // SF_IMMUTABLE
+	{"sappnd", 0x40000}, // SF_APPEND
+}
+
+// readFlags returns the file flags of the regular file or directory at path as the value of a SCHILY.fflags record,
+// or the empty string if it has none. The flags are read without opening the file, so noAtime has no effect.
+func readFlags(path string, noAtime bool) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return "", err
+	}
+	return formatFlags(bsdFlags, uint32(st.Flags)), nil
+}
+
+// writeFlags sets the file flags in the SCHILY.fflags record value flags on the regular file or directory at path.
+// Flags that are not recorded, such as those managed by the file system, are left as they are.
+func writeFlags(path, flags string) error {
+	bits, known, err := parseFlags(bsdFlags, flags)
+	if err != nil {
+		return err
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return err
+	}
+	return unix.Chflags(path, int(uint32(st.Flags)&^known|bits))
+}
@@ -0,0 +1,67 @@
+//go:build linux
+
+package tarmac
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// linuxFlags are the inode flags that are recorded and restored, using the names of the BSD flags that they
+// correspond to. The user and system flags of BSD both map to the single immutable and append-only flags of Linux.
+var linuxFlags = []fileFlag{
+	{"schg", 0x10},    // FS_IMMUTABLE_FL
+	{"sappnd", 0x20},  // FS_APPEND_FL
+	{"nodump", 0x40},  // FS_NODUMP_FL
+	{"noatime", 0x80}, // FS_NOATIME_FL
+	{"uchg", 0x10},
+	{"uappnd", 0x20},
+}
+
+// readFlags returns the file flags of the regular file or directory at path as the value of a SCHILY.fflags record,
+// or the empty string if it has none. File systems that do not support inode flags have none. The file is opened to
+// read its flags, with O_NOATIME if noAtime is set (see openReadOnly).
+func readFlags(path string, noAtime bool) (string, error) {
+	f, err := openReadOnly(path, noAtime)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	bits, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		if unsupportedFlags(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return formatFlags(linuxFlags, bits), nil
+}
+
+// writeFlags sets the file flags in the SCHILY.fflags record value flags on the regular file or directory at path.
+// Flags that are not recorded, such as those managed by the file system, are left as they are.
+func writeFlags(path, flags string) error {
+	bits, known, err := parseFlags(linuxFlags, flags)
+	if err != nil {
+		return err
+	}
+
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	current, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return err
+	}
+	return unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(current&^known|bits))
+}
+
+// unsupportedFlags returns true if err indicates that a file system does not support inode flags.
+func unsupportedFlags(err error) bool {
+	return errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) ||
+		errors.Is(err, unix.EINVAL)
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package tarmac
+
+import "errors"
+
+// readFlags returns the file flags of the regular file or directory at path as the value of a SCHILY.fflags record,
+// or the empty string if it has none. File flags are not supported on this platform.
+func readFlags(path string, noAtime bool) (string, error) {
+	return "", nil
+}
+
+// writeFlags sets the file flags in the SCHILY.fflags record value flags on the regular file or directory at path.
+// File flags are not supported on this platform.
+func writeFlags(path, flags string) error {
+	return errors.New("file flags are not supported on this platform")
+}
@@ -0,0 +1,114 @@
+package tarmac
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+)
+
+// AddFS adds the contents of fsys to the archive under the archive's root path, deduplicating them exactly as AddTree
+// would. This allows archives to be created from sources other than the host's file system, such as an embed.FS or an
+// in-memory testing/fstest.MapFS.
+//
+// Symlinks are archived as symlinks if fsys implements fs.ReadLinkFS, and are otherwise skipped. Dereference,
+// FollowInternal, and Xattrs do not apply to file systems added this way, and their files are never written as sparse
+// entries.
+func (w *Writer) AddFS(fsys fs.FS) error {
+	return w.AddFSContext(context.Background(), fsys)
+}
+
+// AddFSContext is like AddFS, but stops promptly if ctx is canceled, in which case it returns ctx.Err() and the
+// archive is incomplete.
+func (w *Writer) AddFSContext(ctx context.Context, fsys fs.FS) error {
+	if w.rootArchivePath == "" {
+		return errors.New("the archive must have a root path")
+	}
+
+	fi, err := fs.Stat(fsys, ".")
+	if err != nil {
+		return err
+	}
+
+	w.fsys, w.treeRoot, w.treeArchivePath = fsys, "", w.rootArchivePath
+	defer func() { w.fsys = nil }()
+
+	err = w.readTreeExcludes(w.options.IgnoreFile, func() (io.ReadCloser, error) {
+		return fsys.Open(w.options.IgnoreFile)
+	})
+	if err != nil {
+		return err
+	}
+
+	return w.walk(ctx, func() error {
+		return w.addFSDir(".", w.rootArchivePath, fi, true)
+	})
+}
+
+// addFSDir adds the directory at dirPath in the file system that is being added, along with its contents.
+func (w *Writer) addFSDir(dirPath string, archivePath string, fi fs.FileInfo, isRoot bool) error {
+	err := w.addDirHeader(dirPath, archivePath, fi)
+	if err != nil {
+		return err
+	}
+
+	if w.options.GitIgnore {
+		ignores, err := w.readFSIgnoreFile(path.Join(dirPath, ".gitignore"), w.relPath(archivePath))
+		if err != nil {
+			return w.skip(archivePath, err)
+		}
+		if ignores != nil {
+			w.ignores = append(w.ignores, ignores)
+			defer func() { w.ignores = w.ignores[:len(w.ignores)-1] }()
+		}
+	}
+
+	// fs.ReadDir returns the entries sorted by name, so the walk is always reproducible.
+	entries, err := fs.ReadDir(w.fsys, dirPath)
+	if err != nil {
+		return w.skip(archivePath, err)
+	}
+
+	return w.addEntries(archivePath, entries, isRoot, func(entryArchivePath string, fi os.FileInfo) error {
+		return w.addFSEntry(path.Join(dirPath, fi.Name()), entryArchivePath, fi)
+	})
+}
+
+// addFSEntry adds the entry at entryPath in the file system that is being added.
+func (w *Writer) addFSEntry(entryPath string, archivePath string, fi fs.FileInfo) error {
+	switch {
+	case fi.IsDir():
+		return w.addFSDir(entryPath, archivePath, fi, false)
+	case fi.Mode()&fs.ModeSymlink != 0:
+		if _, ok := w.fsys.(fs.ReadLinkFS); !ok {
+			w.warn(archivePath, errors.New("skipping symlink in a file system that does not support reading links"))
+			return nil
+		}
+		return w.addSymlink(entryPath, archivePath, fi)
+	case fi.Mode()&fs.ModeSocket != 0:
+		// Sockets cannot be represented in a tar archive.
+		w.warn(archivePath, errors.New("skipping socket"))
+		return nil
+	case fi.Mode()&(fs.ModeDevice|fs.ModeNamedPipe) != 0:
+		return w.addSpecial(entryPath, archivePath, fi)
+	default:
+		return w.addFile(entryPath, archivePath, fi)
+	}
+}
+
+// readFSIgnoreFile reads the .gitignore file at filePath in the file system that is being added, if any. It returns
+// nil if the file does not exist.
+func (w *Writer) readFSIgnoreFile(filePath, base string) (*ignoreFile, error) {
+	f, err := w.fsys.Open(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseIgnoreFile(f, base)
+}
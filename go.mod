@@ -0,0 +1,11 @@
+module github.com/pgavlin/tarmac
+
+go 1.26.0
+
+require (
+	github.com/dsnet/compress v0.0.1
+	github.com/klauspost/compress v1.20.1
+	github.com/ulikunitz/xz v0.5.17
+	golang.org/x/crypto v0.57.0
+	golang.org/x/sys v0.48.0
+)
@@ -0,0 +1,44 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"os"
+	"strconv"
+)
+
+// The PAX records that identify the source inode of a regular file, following the convention used by star. See
+// Options.HardLinks.
+const (
+	devRecord = "SCHILY.dev"
+	inoRecord = "SCHILY.ino"
+)
+
+// recordInode records the device and inode numbers of the regular file described by fi on its header if the file has
+// more than one hard link. Files with a single link share their inode with no other path, so they need no record.
+func recordInode(header *tar.Header, fi os.FileInfo) {
+	id, links, ok := inodeOf(fi)
+	if !ok || links < 2 {
+		return
+	}
+
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	header.PAXRecords[devRecord] = strconv.FormatUint(id.dev, 10)
+	header.PAXRecords[inoRecord] = strconv.FormatUint(id.ino, 10)
+}
+
+// recordedInode returns the source inode recorded on the regular file or link entry with the given header, formatted
+// as "dev:ino", and whether one was recorded.
+func recordedInode(header *tar.Header) (string, bool) {
+	if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeLink {
+		return "", false
+	}
+
+	dev, hasDev := header.PAXRecords[devRecord]
+	ino, hasIno := header.PAXRecords[inoRecord]
+	if !hasDev || !hasIno {
+		return "", false
+	}
+	return dev + ":" + ino, true
+}
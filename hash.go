@@ -0,0 +1,108 @@
+package tarmac
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// DefaultHash is the name of the hash algorithm used to derive backing file keys if none is specified.
+const DefaultHash = "sha512"
+
+// algorithmFileName is the name of the metadata entry in the backing store that records the hash algorithm used to
+// derive its keys.
+const algorithmFileName = ".algorithm"
+
+var hashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake2b": func() hash.Hash {
+		// New512 only fails if the key is too long.
+		h, _ := blake2b.New512(nil)
+		return h
+	},
+}
+
+// MinHashBytes is the smallest permitted value of Options.HashBytes.
+const MinHashBytes = 16
+
+// checkHash returns an error if the named algorithm is unknown or cannot be truncated to the given number of bytes.
+func checkHash(algorithm string, bytes int) error {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return err
+	}
+	if bytes != 0 && (bytes < MinHashBytes || bytes > h.Size()) {
+		return fmt.Errorf("hash length %d is out of range (%d-%d)", bytes, MinHashBytes, h.Size())
+	}
+	return nil
+}
+
+// hashKey returns the backing store key for a hash, truncating it to the given number of bytes if non-zero.
+func hashKey(sum []byte, bytes int) string {
+	if bytes != 0 && bytes < len(sum) {
+		sum = sum[:bytes]
+	}
+	return base64.URLEncoding.EncodeToString(sum)
+}
+
+// ContentKey returns the backing store key of the contents read from r: their hash under the named algorithm (or
+// DefaultHash if it is empty), truncated to hashBytes bytes if non-zero, as a Writer with the same Options.Hash and
+// Options.HashBytes would store them.
+func ContentKey(r io.Reader, algorithm string, hashBytes int) (string, error) {
+	if err := checkHash(algorithm, hashBytes); err != nil {
+		return "", err
+	}
+
+	h, _ := newHash(algorithm)
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hashKey(h.Sum(nil), hashBytes), nil
+}
+
+// formatAlgorithm returns the contents of a backing store's .algorithm entry: the name of the hash algorithm, followed
+// by a slash and the number of bytes to which hashes are truncated, if any.
+func formatAlgorithm(algorithm string, bytes int) string {
+	if algorithm == "" {
+		algorithm = DefaultHash
+	}
+	if bytes != 0 {
+		algorithm += "/" + strconv.Itoa(bytes)
+	}
+	return algorithm + "\n"
+}
+
+// parseAlgorithm parses the contents of a backing store's .algorithm entry.
+func parseAlgorithm(contents string) (string, int, error) {
+	algorithm, length, truncated := strings.Cut(strings.TrimSpace(contents), "/")
+	if !truncated {
+		return algorithm, 0, nil
+	}
+
+	bytes, err := strconv.Atoi(length)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid hash length %q", length)
+	}
+	return algorithm, bytes, nil
+}
+
+// newHash returns a new hash.Hash that computes the named algorithm.
+func newHash(algorithm string) (hash.Hash, error) {
+	if algorithm == "" {
+		algorithm = DefaultHash
+	}
+
+	newFunc, ok := hashes[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q", algorithm)
+	}
+	return newFunc(), nil
+}
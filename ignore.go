@@ -0,0 +1,179 @@
+package tarmac
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// ignoreRule is a single pattern from a .gitignore file.
+type ignoreRule struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// ignoreFile holds the rules read from a .gitignore file. Rules are matched against paths relative to base, the path
+// of the directory that contains the file relative to the root of the tree.
+type ignoreFile struct {
+	base  string
+	rules []ignoreRule
+}
+
+// readIgnoreFile reads the .gitignore file at filePath, if any. It returns nil if the file does not exist.
+func readIgnoreFile(filePath, base string) (*ignoreFile, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseIgnoreFile(f, base)
+}
+
+func parseIgnoreFile(r io.Reader, base string) (*ignoreFile, error) {
+	ignores := &ignoreFile{base: base}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(scanner.Text()); ok {
+			ignores.rules = append(ignores.rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return ignores, nil
+}
+
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	// Trailing spaces are ignored unless they are escaped with a backslash.
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || line[0] == '#' {
+		return ignoreRule{}, false
+	}
+
+	var rule ignoreRule
+	switch {
+	case line[0] == '!':
+		rule.negate, line = true, line[1:]
+	case strings.HasPrefix(line, "\\!"), strings.HasPrefix(line, "\\#"):
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly, line = true, strings.TrimRight(line, "/")
+	}
+
+	// A pattern that contains a separator at its beginning or in its middle is relative to the directory that contains
+	// the .gitignore file. Any other pattern may match at any level below that directory.
+	rule.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return ignoreRule{}, false
+	}
+
+	rule.segments = strings.Split(line, "/")
+	return rule, true
+}
+
+// match returns true if the rule matches the given path, which must be relative to the rule's .gitignore file.
+func (rule *ignoreRule) match(relPath string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+
+	if !rule.anchored {
+		matched, _ := path.Match(rule.segments[0], path.Base(relPath))
+		return matched
+	}
+	return matchSegments(rule.segments, strings.Split(relPath, "/"))
+}
+
+// matchSegments matches a path against a pattern one segment at a time. A "**" segment matches zero or more path
+// segments.
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// A trailing "**" matches everything inside a directory, but not the directory itself.
+			if len(pattern) == 1 {
+				return len(segments) > 0
+			}
+			for i := len(segments); i >= 0; i-- {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(segments) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], segments[0]); !matched {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+
+	return len(segments) == 0
+}
+
+// parseExcludeFile parses a list of exclude patterns, one per line, skipping blank lines and comments. See
+// Options.IgnoreFile.
+func parseExcludeFile(r io.Reader) ([]string, error) {
+	var patterns []string
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || pattern[0] == '#' {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("line %d: invalid pattern %q: %v", line, pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return patterns, nil
+}
+
+// ignoreStack is the set of .gitignore files that apply to the directory currently being walked, ordered from the
+// root of the tree to the innermost directory.
+type ignoreStack []*ignoreFile
+
+// ignored returns true if the entry at relPath (relative to the root of the tree) is ignored. As in Git, the last
+// matching rule wins, and rules in deeper .gitignore files take precedence over those in their ancestors.
+func (stack ignoreStack) ignored(relPath string, isDir bool) bool {
+	ignored := false
+	for _, ignores := range stack {
+		rel := relPath
+		if ignores.base != "" {
+			if !strings.HasPrefix(relPath, ignores.base+"/") {
+				continue
+			}
+			rel = relPath[len(ignores.base)+1:]
+		}
+
+		for i := range ignores.rules {
+			if rule := &ignores.rules[i]; rule.match(rel, isDir) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
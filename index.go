@@ -0,0 +1,230 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// indexFileName is the name of the entry in the backing store that holds the archive's index. See Options.Index.
+const indexFileName = ".index"
+
+// indexRecord is the PAX record of the global header that follows the index entry at the end of an indexed archive. It
+// gives the offset and size of the index's contents within the archive, separated by a space. The global header is
+// followed in turn by a directory entry for the backing store, as some tar implementations (e.g. Python's tarfile)
+// reject an archive that ends with a global header.
+const indexRecord = "TARMAC.index"
+
+// IndexVersion is the version of the index format written by this package. See Options.Index.
+const IndexVersion = 1
+
+// sparseEncoding is the encoding of an index range that holds the contents of a sparse backing entry, which begin with
+// its sparse map in the GNU 1.0 sparse format.
+const sparseEncoding = "sparse"
+
+// Index maps the regular files of an archive to the ranges of the archive that hold their contents. See Options.Index.
+type Index struct {
+	// Version is the version of the index format.
+	Version int `json:"version"`
+	// Files lists the regular files of the archive in the order in which their entries were written.
+	Files []IndexFile `json:"files"`
+}
+
+// IndexFile describes the contents of a regular file in an Index.
+type IndexFile struct {
+	// Path is the archive path of the file.
+	Path string `json:"path"`
+	// Size is the size of the file's contents.
+	Size int64 `json:"size"`
+	// Ranges are the ranges of the archive whose contents, decoded and concatenated in order, are the contents of the
+	// file. They are empty for an empty file, and for a file whose contents are in a base archive (see AddBase).
+	Ranges []IndexRange `json:"ranges,omitempty"`
+}
+
+// IndexRange is a range of an archive that holds all or part of the contents of a regular file.
+type IndexRange struct {
+	// Offset is the offset of the range from the start of the uncompressed archive.
+	Offset int64 `json:"offset"`
+	// Size is the size of the range.
+	Size int64 `json:"size"`
+	// Encoding, if set, is the encoding of the range's contents: "gzip" for a backing file that is compressed (see
+	// Options.CompressBacking), or "sparse" for a sparse backing file, whose contents begin with a sparse map in the
+	// GNU 1.0 sparse format. The contents of backing files passed to Options.BackingHook are those that it returned.
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// countingWriter counts the bytes written to an underlying writer, so that the offsets of entries can be recorded.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// indexedFile is a regular file whose contents are described by the index once the archive is complete.
+type indexedFile struct {
+	name   string
+	size   int64
+	chunks []chunkRef
+}
+
+// indexing returns true if the Writer records an index. See Options.Index.
+func (w *Writer) indexing() bool {
+	return w.counter != nil
+}
+
+// recordOffset records the range of the archive that holds the contents of the backing entry at name, which begin at
+// the current offset.
+func (w *Writer) recordOffset(name string, size int64, encoding string) {
+	if w.indexing() && path.Dir(path.Clean(name)) == w.storePath() {
+		w.offsets[path.Clean(name)] = IndexRange{Offset: w.counter.n, Size: size, Encoding: encoding}
+	}
+}
+
+// indexFile adds the regular file at name to the index, along with the backing files (or ranges of them) that hold its
+// contents.
+func (w *Writer) indexFile(name string, size int64, chunks ...chunkRef) {
+	if w.indexing() {
+		w.indexed = append(w.indexed, indexedFile{name: name, size: size, chunks: chunks})
+	}
+}
+
+// writeIndex writes the index entry to the backing store, followed by a global header that gives its location and the
+// directory entry of the backing store.
+func (w *Writer) writeIndex() error {
+	index := Index{Version: IndexVersion, Files: make([]IndexFile, 0, len(w.indexed))}
+	for _, f := range w.indexed {
+		file := IndexFile{Path: f.name, Size: f.size}
+		for _, chunk := range f.chunks {
+			r, ok := w.offsets[chunk.path]
+			if !ok {
+				// The contents are in a base archive.
+				file.Ranges = nil
+				break
+			}
+			if chunk.size >= 0 {
+				r.Offset, r.Size = r.Offset+chunk.offset, chunk.size
+			}
+			file.Ranges = append(file.Ranges, r)
+		}
+		index.Files = append(index.Files, file)
+	}
+
+	contents, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	if err = w.writeGlobalHeader(); err != nil {
+		return err
+	}
+
+	name := path.Join(w.storePath(), indexFileName)
+	err = w.writeHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(contents)),
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	offset := w.counter.n
+	if _, err = w.archive.Write(contents); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	err = w.archive.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		PAXRecords: map[string]string{indexRecord: fmt.Sprintf("%d %d", offset, len(contents))},
+		Format:     tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+	err = w.writeHeader(&tar.Header{
+		Name:     w.storePath() + "/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("%s/: %v", w.storePath(), err)
+	}
+	return nil
+}
+
+// isIndex returns true if header is that of one of the entries that end an indexed archive with the given backing
+// stores: the index entry, the global header that gives its location, or the directory entry of the backing store
+// (tarmac writes no other directory entry for a backing store).
+func isIndex(header *tar.Header, stores storeSet) bool {
+	name := path.Clean(header.Name)
+	switch header.Typeflag {
+	case tar.TypeXGlobalHeader:
+		_, ok := header.PAXRecords[indexRecord]
+		return ok
+	case tar.TypeReg:
+		return path.Base(name) == indexFileName && stores.contains(name)
+	case tar.TypeDir:
+		return stores.isStore(name)
+	}
+	return false
+}
+
+// indexTrailerSize bounds the size of the end of an indexed archive that follows the index entry: the global header
+// that gives the location of the index, whose single record fits in one block, the directory entry of the backing
+// store, whose name may need extended headers of its own, and the tar footer.
+const indexTrailerSize = 16 * blockSize
+
+// ReadIndex reads the index of the uncompressed tarmac archive of the given size in r, which was written with
+// Options.Index. Only the end of the archive and the index itself are read, so that the contents of individual files
+// can then be read from their ranges without reading the rest of the archive.
+func ReadIndex(r io.ReaderAt, size int64) (*Index, error) {
+	trailer := make([]byte, min(size, indexTrailerSize))
+	if _, err := r.ReadAt(trailer, size-int64(len(trailer))); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// Search the trailer for the global header, trying the later blocks first. A header's typeflag is at offset 156.
+	var location string
+	for i := len(trailer) - blockSize; i >= 0 && location == ""; i -= blockSize {
+		if trailer[i+156] != tar.TypeXGlobalHeader {
+			continue
+		}
+		header, err := tar.NewReader(bytes.NewReader(trailer[i:])).Next()
+		if err == nil && header.Typeflag == tar.TypeXGlobalHeader {
+			location = header.PAXRecords[indexRecord]
+		}
+	}
+	if location == "" {
+		return nil, errors.New("archive is not indexed")
+	}
+
+	offsetText, sizeText, _ := strings.Cut(location, " ")
+	offset, offsetErr := strconv.ParseInt(offsetText, 10, 64)
+	length, sizeErr := strconv.ParseInt(sizeText, 10, 64)
+	if offsetErr != nil || sizeErr != nil || offset < 0 || length < 0 || offset > size-length {
+		return nil, fmt.Errorf("invalid index location %q", location)
+	}
+
+	var index Index
+	if err := json.NewDecoder(io.NewSectionReader(r, offset, length)).Decode(&index); err != nil {
+		return nil, fmt.Errorf("reading index: %v", err)
+	}
+	if index.Version != IndexVersion {
+		return nil, fmt.Errorf("unsupported index version %d", index.Version)
+	}
+	return &index, nil
+}
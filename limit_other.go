@@ -0,0 +1,9 @@
+//go:build !unix
+
+package tarmac
+
+// openFileLimit returns the process's soft limit on open files, or 0 if it is unknown or unlimited. There is no such
+// limit on this platform.
+func openFileLimit() int {
+	return 0
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package tarmac
+
+import (
+	"math"
+
+	"golang.org/x/sys/unix"
+)
+
+// openFileLimit returns the process's soft limit on open files, or 0 if it is unknown or unlimited.
+func openFileLimit() int {
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limit); err != nil {
+		return 0
+	}
+	if cur := uint64(limit.Cur); cur < math.MaxInt32 {
+		return int(cur)
+	}
+	return 0
+}
@@ -0,0 +1,80 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+)
+
+// Entry describes a logical entry in a tarmac archive.
+type Entry struct {
+	// Header is the entry's header. The link entries of regular files are resolved against their backing files:
+	// Typeflag is tar.TypeReg and Size is the size of the file's contents, and the rest of the file's metadata is that
+	// of its link entry.
+	Header *tar.Header
+	// Key is the backing store key of a regular file's contents. It is empty for all other entries, and for files that
+	// are not stored in the backing store as a whole, such as empty files and chunked files.
+	Key string
+	// Deduplicated is set, for the regular files reported by Options.OnEntry, if the file's contents were already in
+	// the backing store (stored for an earlier file, or in a base or appended-to archive) rather than stored for it. A
+	// chunked file is deduplicated if all of its chunks were. List never sets it.
+	Deduplicated bool
+	// ContentType is the media type of a regular file's contents, if it was recorded by Options.Sniff.
+	ContentType string
+}
+
+// List reads a tarmac archive from r and calls fn for each of its logical entries in archive order, hiding the
+// backing stores. Compressed archives are detected and decompressed transparently. If fn returns an error, List stops
+// and returns that error.
+func List(r io.Reader, fn func(entry Entry) error) error {
+	input, err := openArchive(r)
+	if err != nil {
+		return err
+	}
+
+	// The sizes of the backing files seen so far, by archive path.
+	sizes := make(map[string]int64)
+	stores := make(storeSet)
+
+	archive := tar.NewReader(input)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		stores.observe(header)
+		name := path.Clean(header.Name)
+		if header.Typeflag == tar.TypeReg && stores.contains(name) {
+			sizes[name] = contentSize(header)
+		}
+
+		switch {
+		case header.Typeflag == tar.TypeXGlobalHeader:
+			continue
+		case stores.contains(name), stores.isStore(name):
+			continue
+		}
+
+		entry := Entry{Header: header, ContentType: header.PAXRecords[contentTypeRecord]}
+		if isChunked(header) {
+			header.Size = contentSize(header)
+			delete(header.PAXRecords, encodingRecord)
+			delete(header.PAXRecords, sizeRecord)
+		}
+		if header.Typeflag == tar.TypeLink {
+			linkname := path.Clean(header.Linkname)
+			if size, ok := sizes[linkname]; ok {
+				header.Typeflag, header.Linkname, header.Size = tar.TypeReg, "", size
+				entry.Key = path.Base(linkname)
+			}
+		}
+
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package tarmac
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// mappedChunkSize is the size of the pieces in which mapped contents are written, between which the walk's context is
+// checked and progress is counted.
+const mappedChunkSize = 1 << 20
+
+// mapping is the contents of a file that is mapped into memory. See Options.MmapThreshold.
+type mapping struct {
+	*bytes.Reader
+	data  []byte
+	f     fs.File
+	unmap func() error
+}
+
+func (m *mapping) Close() error {
+	err := m.unmap()
+	if closeErr := m.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// mapContents returns a reader for the contents of f that maps them into memory if Options.MmapThreshold allows it.
+// Otherwise, or if the file cannot be mapped, it returns f itself. Closing the reader closes f.
+func (w *Writer) mapContents(f fs.File) io.ReadCloser {
+	threshold := w.options.MmapThreshold
+	if threshold <= 0 {
+		return f
+	}
+
+	// Only files opened from the host's file system can be mapped, and not if their reads are retried.
+	counted, ok := f.(*countedFile)
+	if !ok {
+		return f
+	}
+	file, ok := counted.File.(*os.File)
+	if !ok {
+		return f
+	}
+
+	fi, err := file.Stat()
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() < threshold || int64(int(fi.Size())) != fi.Size() {
+		return f
+	}
+	data, unmap, err := mapFile(file, fi.Size())
+	if err != nil {
+		w.log(slog.LevelDebug, "not mapped", "path", file.Name(), "error", err)
+		return f
+	}
+	return &mapping{Reader: bytes.NewReader(data), data: data, f: f, unmap: unmap}
+}
+
+// errTruncated is returned when a mapped file is truncated while it is read.
+var errTruncated = errors.New("file was truncated while it was read")
+
+// writeMapped writes mapped contents to dst, counting them in progress if it is non-nil. A fault caused by the file
+// being truncated while it is mapped is returned as an error rather than crashing the process.
+func (w *Writer) writeMapped(dst io.Writer, data []byte, progress *atomic.Int64) (written int64, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(interface{ Addr() uintptr }); ok {
+				err = errTruncated
+				return
+			}
+			panic(r)
+		}
+	}()
+
+	for len(data) > 0 {
+		if err := w.ctx.Err(); err != nil {
+			return written, err
+		}
+
+		n := min(len(data), mappedChunkSize)
+		m, err := dst.Write(data[:n])
+		written += int64(m)
+		if progress != nil {
+			progress.Add(int64(m))
+		}
+		if err != nil {
+			return written, err
+		}
+		data = data[n:]
+	}
+	return written, nil
+}
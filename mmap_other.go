@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package tarmac
+
+import (
+	"errors"
+	"os"
+)
+
+// mapFile maps the first size bytes of f into memory for reading. Files are not mapped on this platform.
+func mapFile(f *os.File, size int64) ([]byte, func() error, error) {
+	return nil, nil, errors.ErrUnsupported
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin
+
+package tarmac
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mapFile maps the first size bytes of f into memory for reading. The returned function unmaps them.
+func mapFile(f *os.File, size int64) ([]byte, func() error, error) {
+	data, err := unix.Mmap(int(f.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The contents are read once, in order.
+	unix.Madvise(data, unix.MADV_SEQUENTIAL)
+	return data, func() error { return unix.Munmap(data) }, nil
+}
@@ -0,0 +1,6 @@
+//go:build !unix
+
+package tarmac
+
+// noFollow is the flag that prevents opening a file through a symlink. There is no such flag on this platform.
+const noFollow = 0
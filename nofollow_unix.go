@@ -0,0 +1,8 @@
+//go:build unix
+
+package tarmac
+
+import "syscall"
+
+// noFollow is the flag that prevents opening a file through a symlink.
+const noFollow = syscall.O_NOFOLLOW
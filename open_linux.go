@@ -0,0 +1,23 @@
+//go:build linux
+
+package tarmac
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openReadOnly opens the file or directory at name for reading. If noAtime is set, it is opened with O_NOATIME so that
+// reading it does not update its access time, unless the caller is not permitted to do so (O_NOATIME requires that the
+// caller own the file or have CAP_FOWNER), in which case it is opened as usual.
+func openReadOnly(name string, noAtime bool) (*os.File, error) {
+	if noAtime {
+		f, err := os.OpenFile(name, os.O_RDONLY|unix.O_NOATIME, 0)
+		if !errors.Is(err, unix.EPERM) {
+			return f, err
+		}
+	}
+	return os.OpenFile(name, os.O_RDONLY, 0)
+}
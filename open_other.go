@@ -0,0 +1,11 @@
+//go:build !linux
+
+package tarmac
+
+import "os"
+
+// openReadOnly opens the file or directory at name for reading. Access times cannot be left untouched on this
+// platform, so noAtime is ignored.
+func openReadOnly(name string, noAtime bool) (*os.File, error) {
+	return os.OpenFile(name, os.O_RDONLY, 0)
+}
@@ -0,0 +1,179 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// packSize is the size of the contents that a pack accumulates before it is written. See Options.PackSmall.
+const packSize = 1 << 20
+
+// pack is a backing file that holds the contents of many small regular files, which are written as chunked files that
+// refer to their ranges of it. See Options.PackSmall.
+type pack struct {
+	contents bytes.Buffer
+	size     int64
+
+	// name is the archive path of the pack's backing file once it has been written.
+	name string
+	// pending holds the files whose contents are in the pack, which are written once it is.
+	pending []packedFile
+}
+
+// packedFile is a regular file whose entry waits for its pack to be written.
+type packedFile struct {
+	header       *tar.Header
+	key          string
+	deduplicated bool
+}
+
+// packs returns true if the contents of a regular file of the given size are packed.
+func (w *Writer) packs(size int64) bool {
+	o := &w.options
+	return o.PackSmall > 0 && size < o.PackSmall && !o.Chunked && !o.SortedStore && !o.NoDedup &&
+		!o.LinkToFirst
+}
+
+// writePacked writes the entries for a small regular file, adding its contents to the current pack unless they are
+// already in the backing store. If the file's pack has yet to be written, its entry is deferred until it is. It must
+// be called on the writing goroutine.
+func (w *Writer) writePacked(entryPath string, header *tar.Header, fi os.FileInfo, hash *fileHash) error {
+	b, ok := w.mapping[hash.key]
+	if ok && b.pack == nil {
+		// The contents are already stored in a backing file of their own (e.g. in a base archive).
+		hash.contents, hash.spillPath = nil, ""
+		return w.writeLink(header, fi, hash.key)
+	}
+
+	if !ok {
+		if w.pack == nil {
+			w.pack = &pack{}
+		}
+
+		size := fi.Size()
+		if !w.options.DryRun {
+			contents, err := w.openContents(entryPath, hash)
+			if err != nil {
+				return fmt.Errorf("%s: %v", header.Name, err)
+			}
+			size, err = w.copy(&w.pack.contents, contents)
+			contents.Close()
+			if err != nil {
+				w.pack.contents.Truncate(int(w.pack.size))
+				return fmt.Errorf("%s: %v", header.Name, err)
+			}
+		}
+
+		b = &backingFile{size: size, pack: w.pack, offset: w.pack.size}
+		w.mapping[hash.key] = b
+		w.pack.size += size
+		w.log(slog.LevelInfo, "packed", "path", header.Name, "key", hash.key, "size", size)
+	}
+	hash.contents, hash.spillPath = nil, ""
+
+	b.refs++
+	if b.pack.name != "" {
+		return w.writePackedFile(header, hash.key, b, ok)
+	}
+	b.pack.pending = append(b.pack.pending, packedFile{header: header, key: hash.key, deduplicated: ok})
+	if w.pack.size >= packSize {
+		return w.flushPack()
+	}
+	return nil
+}
+
+// flushPack writes the backing entry for the current pack, if any, followed by the entries of the files whose contents
+// it holds. It must be called on the writing goroutine.
+func (w *Writer) flushPack() error {
+	p := w.pack
+	if p == nil {
+		return nil
+	}
+	w.pack = nil
+
+	hash, err := newHash(w.options.Hash)
+	if err != nil {
+		return err
+	}
+	hash.Write(p.contents.Bytes())
+	key := hashKey(hash.Sum(nil), w.options.HashBytes)
+	p.name = path.Join(w.storePath(), key)
+
+	// A pack whose contents are already stored in a backing file need not be stored again. (A pack that holds a single
+	// file has that file's key, but the file's contents are only in the pack.)
+	if b, ok := w.mapping[key]; (!ok || b.pack != nil) && !w.options.DryRun {
+		err = w.writeAlgorithm()
+		if err != nil {
+			return err
+		}
+
+		header := &tar.Header{
+			Name:     p.name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     p.size,
+			ModTime:  time.Now(),
+		}
+		if w.options.BackingHook != nil {
+			err = w.writeHooked(key, header, bytes.NewReader(p.contents.Bytes()))
+		} else {
+			err = w.writeHeader(header)
+			if err == nil {
+				archive, _ := w.target(p.name)
+				_, err = archive.Write(p.contents.Bytes())
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", p.name, err)
+		}
+	}
+	w.log(slog.LevelInfo, "stored pack", "key", key, "files", len(p.pending), "size", p.size)
+
+	for _, f := range p.pending {
+		if err := w.writePackedFile(f.header, f.key, w.mapping[f.key], f.deduplicated); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePackedFile writes header as the entry for a regular file whose contents, stored under key, are in a pack that
+// has been written. The entry is a chunk manifest with a single line that gives the range of the pack that holds them.
+// deduplicated reports whether the contents were already in the pack when the file was found.
+func (w *Writer) writePackedFile(header *tar.Header, key string, b *backingFile, deduplicated bool) error {
+	manifest := fmt.Sprintf("%s %d %d\n", b.pack.name, b.offset, b.size)
+
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	header.PAXRecords[encodingRecord] = chunksEncoding
+	header.PAXRecords[sizeRecord] = strconv.FormatInt(b.size, 10)
+	header.Size = int64(len(manifest))
+
+	err := w.writeHeader(header)
+	if err == nil && !w.options.DryRun {
+		_, err = io.WriteString(w.archive, manifest)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", header.Name, err)
+	}
+	w.log(slog.LevelDebug, "linked", "path", header.Name, "key", key)
+	w.indexFile(header.Name, b.size, chunkRef{path: b.pack.name, offset: b.offset, size: b.size})
+
+	// Report the file as List would, with its logical size.
+	logical := *header
+	logical.Size, logical.PAXRecords = b.size, logicalRecords(header.PAXRecords)
+	if w.options.DryRun && w.options.SkipHashing {
+		// The key is not a hash of the file's contents.
+		key = ""
+	}
+	w.added(Entry{Header: &logical, Key: key, Deduplicated: deduplicated})
+	return nil
+}
@@ -0,0 +1,72 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// AddReader adds a regular file at archivePath, which is relative to the archive's root path, whose contents are read
+// from r, deduplicating them exactly as AddTree would. This allows generated contents to be archived without writing
+// them to disk first. The file is given the permission bits (along with any setuid, setgid, and sticky bits) of mode
+// and the current time as its modification time. Its parent directories are not added.
+//
+// If size is non-negative, r must yield exactly size bytes; otherwise, r is read until EOF. As the contents can only be
+// read once, contents that are larger than the BufferThreshold or of unknown size are copied into a temporary
+// directory until they are written.
+func (w *Writer) AddReader(archivePath string, size int64, mode os.FileMode, r io.Reader) error {
+	return w.AddReaderContext(context.Background(), archivePath, size, mode, r)
+}
+
+// AddReaderContext is like AddReader, but stops promptly if ctx is canceled, in which case it returns ctx.Err() and
+// the file is not added.
+func (w *Writer) AddReaderContext(ctx context.Context, archivePath string, size int64, mode os.FileMode, r io.Reader) error {
+	name := path.Join(w.rootArchivePath, strings.TrimPrefix(path.Clean("/"+archivePath), "/"))
+	if name == "" {
+		return errors.New("the archive must have a root path or the file must be added under a path")
+	}
+
+	name, ok, err := w.archiveName(name)
+	if !ok {
+		return err
+	}
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if _, err := w.checkDuplicate("", name, false); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if err := w.checkCase(name); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	perm := int64(mode.Perm())
+	for bit, flag := range map[os.FileMode]int64{os.ModeSetuid: 04000, os.ModeSetgid: 02000, os.ModeSticky: 01000} {
+		if mode&bit != 0 {
+			perm |= flag
+		}
+	}
+	header := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: perm, ModTime: time.Now()}
+
+	w.stream = true
+	defer func() { w.stream = false }()
+
+	return w.walk(ctx, func() error {
+		hash := w.hashTarFile(name, size, r)
+		switch {
+		case hash.err != nil:
+			return fmt.Errorf("%s: %v", name, hash.err)
+		case size >= 0 && hash.size != size:
+			return fmt.Errorf("%s: read %d bytes rather than %d", name, hash.size, size)
+		}
+
+		header.Size = hash.size
+		return w.emitTarFile(header, tarFile{hash: hash, size: hash.size})
+	})
+}
@@ -0,0 +1,142 @@
+package tarmac
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Rename is a rule that rewrites the archive paths of entries. See Options.Renames.
+type Rename struct {
+	// Pattern is matched against the path of each entry relative to the archive's root path, without a trailing
+	// slash.
+	Pattern *regexp.Regexp
+	// Replacement replaces the leftmost match of Pattern, expanded as by regexp.Regexp.Expand, so that $1 or ${name}
+	// is replaced by the text of a submatch.
+	Replacement string
+}
+
+// GlobRename returns a rule that renames the paths that match the glob pattern from (in the syntax of path.Match) to
+// the glob pattern to, in which each * or ? is replaced by the text matched by the corresponding wildcard (*, ?, or
+// character class) in from, in order. A path within a directory that matches from is renamed along with the directory;
+// for example, a rule from build/linux_amd64/* to bin/* renames build/linux_amd64/tool to bin/tool and
+// build/linux_amd64/lib/a.so to bin/lib/a.so. Either pattern may escape a wildcard with a backslash.
+func GlobRename(from, to string) (Rename, error) {
+	if _, err := path.Match(from, ""); err != nil {
+		return Rename{}, fmt.Errorf("invalid pattern %q: %v", from, err)
+	}
+
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	wildcards := 0
+	for i := 0; i < len(from); i++ {
+		switch c := from[i]; c {
+		case '*':
+			pattern.WriteString("([^/]*)")
+			wildcards++
+		case '?':
+			pattern.WriteString("([^/])")
+			wildcards++
+		case '[':
+			// path.Match has accepted the pattern, so the class is terminated. Its syntax is that of a regexp class,
+			// except that escaped characters are quoted, as is [. A negated class never matches a slash.
+			pattern.WriteString("([")
+			wildcards++
+			i++
+			if from[i] == '^' {
+				pattern.WriteString("^/")
+				i++
+			}
+			for ; from[i] != ']'; i++ {
+				switch from[i] {
+				case '\\':
+					i++
+					pattern.WriteString(regexp.QuoteMeta(from[i : i+1]))
+				case '[':
+					pattern.WriteString(`\[`)
+				default:
+					pattern.WriteByte(from[i])
+				}
+			}
+			pattern.WriteString("])")
+		case '\\':
+			i++
+			pattern.WriteString(regexp.QuoteMeta(from[i : i+1]))
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	// The rest of the path, if any, is that of an entry within a matching directory.
+	pattern.WriteString("(/.*)?$")
+
+	var replacement strings.Builder
+	n := 0
+	for i := 0; i < len(to); i++ {
+		switch c := to[i]; c {
+		case '*', '?':
+			n++
+			if n > wildcards {
+				return Rename{}, fmt.Errorf("%q has more wildcards than %q", to, from)
+			}
+			replacement.WriteString("${" + strconv.Itoa(n) + "}")
+		case '\\':
+			if i+1 < len(to) {
+				i++
+			}
+			replacement.WriteString(strings.ReplaceAll(to[i:i+1], "$", "$$"))
+		case '$':
+			replacement.WriteString("$$")
+		default:
+			replacement.WriteByte(c)
+		}
+	}
+	replacement.WriteString("${" + strconv.Itoa(wildcards+1) + "}")
+
+	re, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return Rename{}, fmt.Errorf("invalid pattern %q: %v", from, err)
+	}
+	return Rename{Pattern: re, Replacement: replacement.String()}, nil
+}
+
+// renamePath applies the first of Options.Renames that matches archivePath, which lies under the archive's root path,
+// preserving any trailing slash. The root path itself is never renamed. Renamed paths are confined to the root path as
+// those given to AddReader are, and may not name a backing store.
+func (w *Writer) renamePath(archivePath string) (string, error) {
+	if len(w.options.Renames) == 0 {
+		return archivePath, nil
+	}
+
+	trimmed := strings.TrimSuffix(archivePath, "/")
+	rel := trimmed
+	if w.rootArchivePath != "" {
+		if !strings.HasPrefix(trimmed, w.rootArchivePath+"/") {
+			return archivePath, nil
+		}
+		rel = trimmed[len(w.rootArchivePath)+1:]
+	}
+
+	for _, rename := range w.options.Renames {
+		match := rename.Pattern.FindStringSubmatchIndex(rel)
+		if match == nil {
+			continue
+		}
+
+		renamed := rel[:match[0]] + string(rename.Pattern.ExpandString(nil, rename.Replacement, rel, match)) +
+			rel[match[1]:]
+		renamed = path.Clean("/" + renamed)
+		if renamed == "/" {
+			return "", fmt.Errorf("renaming %s leaves no path within the archive", rel)
+		}
+		for i, segment := range strings.Split(renamed[1:], "/") {
+			if segment == DefaultStoreName || (i == 0 && segment == w.storeName()) {
+				return "", fmt.Errorf("renaming %s to %s uses the name %s, which is reserved for backing stores", rel,
+					renamed[1:], segment)
+			}
+		}
+		return path.Join(w.rootArchivePath, renamed[1:]) + archivePath[len(trimmed):], nil
+	}
+	return archivePath, nil
+}
@@ -0,0 +1,451 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// repairKey identifies the contents of a backing file by the algorithm of its backing store, as recorded in the
+// store's .algorithm entry, and its key.
+type repairKey struct {
+	algorithm, key string
+}
+
+// repairSource locates contents that can replace a missing backing file.
+type repairSource struct {
+	path string
+	temp bool
+}
+
+// Repair reads the tarmac archive in r and writes a copy of it to w in which missing backing files are restored from
+// the given sources, which are paths to tarmac archives or directories. A backing file is missing if a hard link
+// entry or a chunk manifest (see Options.Chunked and Options.PackSmall) refers to it but it does not precede the entry
+// in the archive. Any regular file in a source whose contents hash to the key of a missing backing file can take its
+// place, so sources need not be related to the damaged archive. Compressed archives are detected and decompressed
+// transparently; the copy is written uncompressed. The index of an indexed archive (see Options.Index) is not copied,
+// as the offsets that it records would not hold in the copy.
+//
+// Files in source directories that cannot be read are skipped. warn, if non-nil, is called for each of them.
+//
+// The archive in r is read twice, so r must be seekable. Repair returns the entries whose backing files could not be
+// repaired, which are copied as they are. The returned error is non-nil only if the archive could not be repaired.
+func Repair(r io.ReadSeeker, w io.Writer, sources []string, warn func(path string, err error)) ([]*VerifyError, error) {
+	missing, err := findMissing(r)
+	if err != nil {
+		return nil, err
+	}
+
+	want, found := wanted(missing), make(map[repairKey]*repairSource)
+	defer func() {
+		for _, source := range found {
+			if source.temp {
+				os.Remove(source.path)
+			}
+		}
+	}()
+
+	for _, source := range sources {
+		if len(found) == len(want) {
+			break
+		}
+
+		fi, err := os.Stat(source)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			err = searchDir(source, missing, found, warn)
+		} else {
+			err = searchArchive(source, missing, found)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", source, err)
+		}
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	input, err := openArchive(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []*VerifyError
+	entries := make(map[string]bool)
+	stores := make(storeSet)
+	archive, output := tar.NewReader(input), tar.NewWriter(w)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return problems, err
+		}
+		stores.observe(header)
+		if isIndex(header, stores) {
+			continue
+		}
+
+		// The backing files that the entry refers to, which must precede it.
+		var refs []string
+		contents := io.Reader(archive)
+		switch {
+		case header.Typeflag == tar.TypeLink:
+			refs = []string{path.Clean(header.Linkname)}
+		case isChunked(header):
+			manifest, err := io.ReadAll(archive)
+			if err != nil {
+				return problems, err
+			}
+			chunks, err := readManifest(bytes.NewReader(manifest), nil)
+			if err != nil {
+				return problems, err
+			}
+			// A manifest may refer to the same chunk more than once.
+			seen := make(map[string]bool)
+			for _, chunk := range chunks {
+				if !seen[chunk.path] {
+					seen[chunk.path] = true
+					refs = append(refs, chunk.path)
+				}
+			}
+			contents = bytes.NewReader(manifest)
+		}
+		for _, ref := range refs {
+			if entries[ref] {
+				continue
+			}
+			if source, ok := found[missing[ref]]; ok {
+				err = writeRepaired(output, ref, header, source)
+				if err != nil {
+					return problems, err
+				}
+				entries[ref] = true
+			} else {
+				problems = append(problems, &VerifyError{Path: header.Name, Err: fmt.Errorf("no source for %s", ref)})
+			}
+		}
+		if header.Typeflag != tar.TypeXGlobalHeader {
+			entries[path.Clean(header.Name)] = true
+		}
+
+		// Sparse entries are expanded by tar.Reader, so they are copied as regular entries.
+		stripSparseRecords(header)
+
+		err = output.WriteHeader(header)
+		if err != nil {
+			return problems, err
+		}
+		_, err = io.Copy(output, contents)
+		if err != nil {
+			return problems, err
+		}
+	}
+
+	return problems, output.Close()
+}
+
+// findMissing reads the archive in r and returns the missing backing files that are referred to by its link entries
+// and chunk manifests, along with the keys of their contents.
+func findMissing(r io.Reader) (map[string]repairKey, error) {
+	input, err := openArchive(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The hash algorithms of the backing stores, as recorded in their .algorithm entries.
+	algorithms := make(map[string]string)
+	entries := make(map[string]bool)
+	missing := make(map[string]repairKey)
+	stores := make(storeSet)
+
+	archive := tar.NewReader(input)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean(header.Name)
+		switch header.Typeflag {
+		case tar.TypeXGlobalHeader:
+			stores.observe(header)
+			continue
+		case tar.TypeLink:
+			if linkname := path.Clean(header.Linkname); !entries[linkname] && stores.contains(linkname) {
+				missing[linkname] = repairKey{key: path.Base(linkname)}
+			}
+		case tar.TypeReg:
+			if isChunked(header) {
+				// The chunks of chunked files and the packs of packed files are backing files like any other.
+				chunks, err := readManifest(archive, nil)
+				if err != nil {
+					return nil, err
+				}
+				for _, chunk := range chunks {
+					if !entries[chunk.path] && stores.contains(chunk.path) {
+						missing[chunk.path] = repairKey{key: path.Base(chunk.path)}
+					}
+				}
+			} else if store, key := path.Split(name); stores.contains(name) && key == algorithmFileName {
+				contents, err := io.ReadAll(archive)
+				if err != nil {
+					return nil, err
+				}
+				algorithms[path.Clean(store)] = string(contents)
+			}
+		}
+		entries[name] = true
+	}
+
+	// Stores without an .algorithm entry use the default.
+	for linkname, key := range missing {
+		algorithm, ok := algorithms[path.Dir(linkname)]
+		if !ok {
+			algorithm = formatAlgorithm(DefaultHash, 0)
+		}
+		key.algorithm = algorithm
+		missing[linkname] = key
+	}
+	return missing, nil
+}
+
+// repairHasher computes the keys of contents under each of the algorithms of the missing backing files.
+type repairHasher struct {
+	algorithms []string
+	bytes      []int
+	hashes     []hash.Hash
+}
+
+func newRepairHasher(missing map[string]repairKey) (*repairHasher, error) {
+	seen := make(map[string]bool)
+	hasher := &repairHasher{}
+	for _, key := range missing {
+		if seen[key.algorithm] {
+			continue
+		}
+		seen[key.algorithm] = true
+
+		algorithm, bytes, err := parseAlgorithm(key.algorithm)
+		if err == nil {
+			err = checkHash(algorithm, bytes)
+		}
+		if err != nil {
+			return nil, err
+		}
+		hash, _ := newHash(algorithm)
+
+		hasher.algorithms = append(hasher.algorithms, key.algorithm)
+		hasher.bytes = append(hasher.bytes, bytes)
+		hasher.hashes = append(hasher.hashes, hash)
+	}
+	return hasher, nil
+}
+
+// keys hashes the contents read from r and returns their key under each algorithm.
+func (hasher *repairHasher) keys(r io.Reader) ([]repairKey, error) {
+	writers := make([]io.Writer, len(hasher.hashes))
+	for i, hash := range hasher.hashes {
+		hash.Reset()
+		writers[i] = hash
+	}
+
+	_, err := io.Copy(io.MultiWriter(writers...), r)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]repairKey, len(hasher.hashes))
+	for i, hash := range hasher.hashes {
+		keys[i] = repairKey{algorithm: hasher.algorithms[i], key: hashKey(hash.Sum(nil), hasher.bytes[i])}
+	}
+	return keys, nil
+}
+
+// wanted returns the set of keys of the missing backing files.
+func wanted(missing map[string]repairKey) map[repairKey]bool {
+	keys := make(map[repairKey]bool)
+	for _, key := range missing {
+		keys[key] = true
+	}
+	return keys
+}
+
+// searchDir hashes the regular files in the tree at dir and records those that match missing backing files. Files and
+// directories that cannot be read are skipped and passed to warn, if it is non-nil.
+func searchDir(dir string, missing map[string]repairKey, found map[repairKey]*repairSource,
+	warn func(path string, err error)) error {
+	hasher, err := newRepairHasher(missing)
+	if err != nil {
+		return err
+	}
+	want := wanted(missing)
+
+	skip := func(filePath string, err error) {
+		if warn != nil {
+			warn(filePath, err)
+		}
+	}
+	return filepath.WalkDir(dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			skip(filePath, err)
+			if entry != nil && entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(filePath)
+		if err != nil {
+			skip(filePath, err)
+			return nil
+		}
+		defer f.Close()
+
+		keys, err := hasher.keys(f)
+		if err != nil {
+			skip(filePath, err)
+			return nil
+		}
+		for _, key := range keys {
+			if want[key] && found[key] == nil {
+				found[key] = &repairSource{path: filePath}
+			}
+		}
+		return nil
+	})
+}
+
+// searchArchive hashes the regular files in the archive at archivePath and records those that match missing backing
+// files. The matching contents are copied to temporary files once the archive has been searched.
+func searchArchive(archivePath string, missing map[string]repairKey, found map[repairKey]*repairSource) error {
+	hasher, err := newRepairHasher(missing)
+	if err != nil {
+		return err
+	}
+	want := wanted(missing)
+
+	// The indices of the matching entries in the archive.
+	matches := make(map[int]repairKey)
+	err = readArchiveFile(archivePath, func(i int, header *tar.Header, archive io.Reader) error {
+		if header.Typeflag != tar.TypeReg || isChunked(header) {
+			return nil
+		}
+
+		r, err := contents(header, archive)
+		if err != nil {
+			return err
+		}
+		keys, err := hasher.keys(r)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if want[key] && found[key] == nil {
+				found[key], matches[i] = &repairSource{}, key
+			}
+		}
+		return nil
+	})
+	if err != nil || len(matches) == 0 {
+		return err
+	}
+
+	return readArchiveFile(archivePath, func(i int, header *tar.Header, archive io.Reader) error {
+		key, ok := matches[i]
+		if !ok {
+			return nil
+		}
+
+		f, err := os.CreateTemp("", "tarmac-repair")
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		found[key].path, found[key].temp = f.Name(), true
+
+		r, err := contents(header, archive)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		return err
+	})
+}
+
+// readArchiveFile calls fn with the index, header, and contents of each entry in the archive at archivePath.
+func readArchiveFile(archivePath string, fn func(i int, header *tar.Header, contents io.Reader) error) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	input, err := openArchive(f)
+	if err != nil {
+		return err
+	}
+
+	archive := tar.NewReader(input)
+	for i := 0; ; i++ {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = fn(i, header, archive); err != nil {
+			return err
+		}
+	}
+}
+
+// writeRepaired writes a backing file at linkname with the contents of source, taking its metadata from the entry
+// that refers to it.
+func writeRepaired(output *tar.Writer, linkname string, referrer *tar.Header, source *repairSource) error {
+	f, err := os.Open(source.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = output.WriteHeader(&tar.Header{
+		Name:     linkname,
+		Typeflag: tar.TypeReg,
+		Mode:     referrer.Mode,
+		Uid:      referrer.Uid,
+		Gid:      referrer.Gid,
+		Uname:    referrer.Uname,
+		Gname:    referrer.Gname,
+		ModTime:  referrer.ModTime,
+		Size:     fi.Size(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(output, f)
+	return err
+}
@@ -0,0 +1,94 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"path"
+	"testing"
+)
+
+// dropBackingFiles returns a copy of the archive without its backing files, other than the record of the backing
+// store's hash algorithm.
+func dropBackingFiles(t *testing.T, archive []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	r, w := tar.NewReader(bytes.NewReader(archive)), tar.NewWriter(&buf)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, key := path.Split(path.Clean(header.Name))
+		if path.Base(store) == DefaultStoreName && key != algorithmFileName {
+			continue
+		}
+		if err = w.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.Copy(w, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRepairManifests(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+	}{
+		{"chunked", Options{Chunked: true}},
+		{"packed", Options{PackSmall: 1024}},
+	}
+
+	// Each file is small enough to be a single chunk, or alone in its pack, so the files themselves can take the
+	// place of the backing files.
+	files := map[string]string{"f": "contents"}
+	dir := writeTree(t, files)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			damaged := dropBackingFiles(t, archiveTree(t, dir, test.options))
+			problems, err := Verify(bytes.NewReader(damaged))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(problems) == 0 {
+				t.Fatal("the damaged archive verified")
+			}
+
+			// Without a source, the file that refers to the missing backing file is reported.
+			problems, err = Repair(bytes.NewReader(damaged), io.Discard, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(problems) != 1 || problems[0].Path != "root/f" {
+				t.Fatalf("got problems %v, want one for root/f", problems)
+			}
+
+			var repaired bytes.Buffer
+			problems, err = Repair(bytes.NewReader(damaged), &repaired, []string{dir}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(problems) != 0 {
+				t.Fatalf("got problems %v", problems)
+			}
+			problems, err = Verify(bytes.NewReader(repaired.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(problems) != 0 {
+				t.Fatalf("the repaired archive has problems %v", problems)
+			}
+			checkTree(t, extractArchive(t, repaired.Bytes()), map[string]string{"root/": "", "root/f": "contents"})
+		})
+	}
+}
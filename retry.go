@@ -0,0 +1,130 @@
+package tarmac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// DefaultRetryDelay is the default value of Options.RetryDelay.
+const DefaultRetryDelay = time.Second
+
+// maxRetryDelay is the delay beyond which the delay between retries stops doubling.
+const maxRetryDelay = time.Minute
+
+// isTransient returns true if err may not recur if the operation that failed is retried (e.g. an I/O error on a network
+// file system). Errors that describe the file itself, such as its not existing or being inaccessible, are permanent.
+func isTransient(err error) bool {
+	for _, permanent := range []error{fs.ErrNotExist, fs.ErrPermission, fs.ErrInvalid, fs.ErrClosed,
+		context.Canceled, context.DeadlineExceeded} {
+		if errors.Is(err, permanent) {
+			return false
+		}
+	}
+	return true
+}
+
+// retrier tracks the retries of the operations on a single file. The delay between attempts doubles after each one.
+type retrier struct {
+	w         *Writer
+	entryPath string
+	retries   int
+}
+
+// retry waits before err's operation is retried and returns true, or returns false if it should not be retried.
+func (r *retrier) retry(err error) bool {
+	if r.retries >= r.w.options.Retries || !isTransient(err) {
+		return false
+	}
+
+	delay := r.w.options.RetryDelay
+	if delay == 0 {
+		delay = DefaultRetryDelay
+	}
+	for i := 0; i < r.retries && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	r.retries++
+
+	r.w.warn(r.entryPath, fmt.Errorf("retrying in %v: %v", delay, err))
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.w.ctx.Done():
+		return false
+	}
+}
+
+// retryFile is a file that is reopened if reading it fails with a transient error, resuming from the same offset.
+type retryFile struct {
+	fs.File
+	retrier *retrier
+	offset  int64
+}
+
+// openRetrying opens the file at entryPath, retrying on transient errors as configured by Options.Retries.
+func (w *Writer) openRetrying(entryPath string) (fs.File, error) {
+	r := &retrier{w: w, entryPath: entryPath}
+	for {
+		f, err := w.open(entryPath)
+		if err == nil {
+			return &retryFile{File: f, retrier: r}, nil
+		}
+		if !r.retry(err) {
+			return nil, err
+		}
+	}
+}
+
+func (f *retryFile) Read(b []byte) (int, error) {
+	for {
+		n, err := f.File.Read(b)
+		f.offset += int64(n)
+		if err == nil || err == io.EOF || !f.retrier.retry(err) {
+			return n, err
+		}
+
+		if err := f.reopen(); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// reopen replaces the file with a new handle positioned at the offset that has been read so far.
+func (f *retryFile) reopen() error {
+	f.File.Close()
+
+	for {
+		file, err := f.retrier.w.open(f.retrier.entryPath)
+		if err == nil {
+			err = seek(file, f.offset)
+			if err == nil {
+				f.File = file
+				return nil
+			}
+			file.Close()
+		}
+		if !f.retrier.retry(err) {
+			return err
+		}
+	}
+}
+
+// seek positions f at offset, reading and discarding its contents if it is not an io.Seeker.
+func seek(f fs.File, offset int64) error {
+	if seeker, ok := f.(io.Seeker); ok {
+		_, err := seeker.Seek(offset, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, f, offset)
+	return err
+}
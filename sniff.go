@@ -0,0 +1,46 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"net/http"
+)
+
+// contentTypeRecord is the PAX record that gives the media type detected from the contents of a regular file. See
+// Options.Sniff.
+const contentTypeRecord = "TARMAC.mimetype"
+
+// sniffSize is the number of leading bytes of a file's contents from which http.DetectContentType detects its media
+// type.
+const sniffSize = 512
+
+// sniffer retains the first sniffSize bytes written to it, so that the media type of a file's contents can be detected
+// while they are hashed.
+type sniffer struct {
+	head []byte
+}
+
+func (s *sniffer) Write(b []byte) (int, error) {
+	if n := sniffSize - len(s.head); n > 0 {
+		s.head = append(s.head, b[:min(n, len(b))]...)
+	}
+	return len(b), nil
+}
+
+// contentType returns the media type of contents that begin with head, or "" if there are none.
+func contentType(head []byte) string {
+	if len(head) == 0 {
+		return ""
+	}
+	return http.DetectContentType(head[:min(sniffSize, len(head))])
+}
+
+// setContentType records contentType, if any, in header.
+func setContentType(header *tar.Header, contentType string) {
+	if contentType == "" {
+		return
+	}
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	header.PAXRecords[contentTypeRecord] = contentType
+}
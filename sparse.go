@@ -0,0 +1,177 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// sparseRegion is a range of a sparse file that contains data. The rest of the file consists of holes, which read as
+// zeros.
+type sparseRegion struct {
+	offset, length int64
+}
+
+// isSparse returns true if the given data regions of a file of the given size leave any holes.
+func isSparse(regions []sparseRegion, size int64) bool {
+	var length int64
+	for _, region := range regions {
+		length += region.length
+	}
+	return length < size
+}
+
+// paxRecord formats a PAX extended header record. The length that prefixes the record includes itself.
+func paxRecord(key, value string) string {
+	const padding = len(" =\n")
+	size := len(key) + len(value) + padding
+	size += len(strconv.Itoa(size))
+	record := strconv.Itoa(size) + " " + key + "=" + value + "\n"
+
+	// The length of the length may have grown the record.
+	if len(record) != size {
+		size = len(record)
+		record = strconv.Itoa(size) + " " + key + "=" + value + "\n"
+	}
+	return record
+}
+
+// paxTime formats a PAX time record, with nanosecond resolution if precise is true.
+func paxTime(t time.Time, precise bool) string {
+	if !precise || t.Nanosecond() == 0 {
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
+
+// ustarHeader encodes header as a USTAR header block. If typeflag is non-zero, it replaces the type of the encoded
+// header.
+func ustarHeader(header *tar.Header, typeflag byte) ([]byte, error) {
+	var buf bytes.Buffer
+	err := tar.NewWriter(&buf).WriteHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	block := buf.Bytes()
+	if typeflag != 0 {
+		// tar.Writer refuses to encode extended headers directly, so patch the type and recompute the checksum.
+		block[156] = typeflag
+
+		copy(block[148:156], "        ")
+		var sum int64
+		for _, b := range block {
+			sum += int64(b)
+		}
+		copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	}
+	return block, nil
+}
+
+// padding returns the zeros that follow n bytes of contents to fill the last block.
+func padding(n int64) []byte {
+	if pad := n % blockSize; pad != 0 {
+		return make([]byte, blockSize-pad)
+	}
+	return nil
+}
+
+// writeSparse writes a backing entry for the sparse file f in the PAX 1.0 sparse format, storing only its data
+// regions. tar.Writer does not support writing sparse files, so the entry is encoded by hand and written directly to
+// the underlying io.Writer; sparse entries are read transparently by tar.Reader, GNU tar and libarchive.
+func (w *Writer) writeSparse(f *os.File, header *tar.Header, regions []sparseRegion) error {
+	w.normalize(header)
+
+	// The data begins with the sparse map, padded to a whole number of blocks.
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(regions))
+	physicalSize := int64(0)
+	for _, region := range regions {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", region.offset, region.length)
+		physicalSize += region.length
+	}
+	sparseMap.Write(padding(int64(sparseMap.Len())))
+	physicalSize += int64(sparseMap.Len())
+
+	records := paxRecord("GNU.sparse.major", "1") +
+		paxRecord("GNU.sparse.minor", "0") +
+		paxRecord("GNU.sparse.name", header.Name) +
+		paxRecord("GNU.sparse.realsize", strconv.FormatInt(header.Size, 10)) +
+		paxRecord("mtime", paxTime(header.ModTime, w.options.PAX)) +
+		paxRecord("uid", strconv.Itoa(header.Uid)) +
+		paxRecord("gid", strconv.Itoa(header.Gid)) +
+		paxRecord("uname", header.Uname) +
+		paxRecord("gname", header.Gname)
+
+	// The USTAR header's own fields are placeholders for readers that do not understand the PAX records above.
+	placeholder := path.Join("GNUSparseFile.0", path.Base(header.Name))
+	if len(placeholder) > 99 {
+		placeholder = placeholder[:99]
+	}
+	modTime := header.ModTime.Truncate(time.Second)
+	if modTime.Unix() < 0 {
+		modTime = time.Unix(0, 0)
+	}
+
+	extended, err := ustarHeader(&tar.Header{
+		Name:     path.Join("PaxHeaders.0", path.Base(placeholder)),
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(records)),
+		ModTime:  modTime,
+		Format:   tar.FormatUSTAR,
+	}, tar.TypeXHeader)
+	if err != nil {
+		return err
+	}
+
+	entry, err := ustarHeader(&tar.Header{
+		Name:     placeholder,
+		Typeflag: tar.TypeReg,
+		Mode:     header.Mode & 07777,
+		Size:     physicalSize,
+		ModTime:  modTime,
+		Format:   tar.FormatUSTAR,
+	}, 0)
+	if err != nil {
+		return err
+	}
+
+	// Finish any preceding entry before writing to the underlying io.Writer.
+	archive, output := w.target(header.Name)
+	err = archive.Flush()
+	if err != nil {
+		return err
+	}
+
+	for _, b := range [][]byte{extended, []byte(records), padding(int64(len(records))), entry} {
+		_, err = output.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+	w.recordOffset(header.Name, physicalSize, sparseEncoding)
+	_, err = output.Write(sparseMap.Bytes())
+	if err != nil {
+		return err
+	}
+
+	for _, region := range regions {
+		// The entry's size is already written, so a file that has since been truncated cannot be written in full.
+		n, err := w.copy(output, io.NewSectionReader(f, region.offset, region.length))
+		if err == nil && n < region.length {
+			err = errSizeChanged
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = output.Write(padding(physicalSize))
+	return err
+}
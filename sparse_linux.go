@@ -0,0 +1,47 @@
+//go:build linux
+
+package tarmac
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// sparseRegions returns the data regions of the file f of the given size, as reported by SEEK_DATA and SEEK_HOLE. If
+// the filesystem does not report holes, the whole file is a single data region.
+func sparseRegions(f *os.File, size int64) ([]sparseRegion, error) {
+	fd := int(f.Fd())
+
+	var regions []sparseRegion
+	for offset := int64(0); offset < size; {
+		data, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if err != nil {
+			if err == unix.ENXIO {
+				// The rest of the file is a hole.
+				break
+			}
+			if err == unix.EINVAL {
+				return []sparseRegion{{offset: 0, length: size}}, nil
+			}
+			return nil, err
+		}
+
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		if hole > size {
+			hole = size
+		}
+
+		regions = append(regions, sparseRegion{offset: data, length: hole - data})
+		offset = hole
+	}
+
+	// A trailing hole is recorded as an empty region at the end of the file, as GNU tar does.
+	if n := len(regions); n == 0 || regions[n-1].offset+regions[n-1].length < size {
+		regions = append(regions, sparseRegion{offset: size, length: 0})
+	}
+	return regions, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package tarmac
+
+import "os"
+
+// sparseRegions returns the data regions of the file f of the given size. Holes cannot be detected on this platform,
+// so the whole file is a single data region.
+func sparseRegions(f *os.File, size int64) ([]sparseRegion, error) {
+	return []sparseRegion{{offset: 0, length: size}}, nil
+}
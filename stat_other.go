@@ -0,0 +1,11 @@
+//go:build !unix
+
+package tarmac
+
+import "os"
+
+// inodeOf returns the device and inode numbers of the file described by fi and its number of hard links, and whether
+// these are available. Inode numbers are not available on this platform.
+func inodeOf(fi os.FileInfo) (inode, uint64, bool) {
+	return inode{}, 0, false
+}
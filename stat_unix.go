@@ -0,0 +1,18 @@
+//go:build unix
+
+package tarmac
+
+import (
+	"os"
+	"syscall"
+)
+
+// inodeOf returns the device and inode numbers of the file described by fi and its number of hard links, and whether
+// these are available.
+func inodeOf(fi os.FileInfo) (inode, uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return inode{}, 0, false
+	}
+	return inode{dev: uint64(st.Dev), ino: uint64(st.Ino)}, uint64(st.Nlink), true
+}
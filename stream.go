@@ -0,0 +1,61 @@
+package tarmac
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Stream archives the directory at root under its base name and returns a reader from which the archive can be read as
+// it is written, e.g. to pass it to an HTTP request without buffering it. The archive is written by a separate
+// goroutine that blocks until the reader consumes its output, so a slow reader pauses the walk. Any error encountered
+// while writing the archive is returned by the reader in place of io.EOF.
+//
+// Closing the reader before the archive is complete cancels its creation, as does canceling ctx. The archive is not
+// compressed; options.Compression is only recorded in its global header.
+func Stream(ctx context.Context, root string, options Options) (io.ReadCloser, error) {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	if err := checkHash(options.Hash, options.HashBytes); err != nil {
+		return nil, err
+	}
+
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	_, name := filepath.Split(root)
+
+	ctx, cancel := context.WithCancel(ctx)
+	r, w := io.Pipe()
+	go func() {
+		defer cancel()
+
+		archive := NewWriterOptions(w, name, options)
+		err := archive.AddTreeContext(ctx, root)
+		if err == nil {
+			err = archive.Close()
+		}
+		w.CloseWithError(err)
+	}()
+
+	return &streamReader{PipeReader: r, cancel: cancel}, nil
+}
+
+// streamReader is the reader returned by Stream.
+type streamReader struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (r *streamReader) Close() error {
+	r.cancel()
+	return r.PipeReader.Close()
+}
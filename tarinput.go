@@ -0,0 +1,185 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+)
+
+// AddTar adds the entries of the tar archive in r to the archive under the archive's root path, deduplicating the
+// contents of its regular files exactly as AddTree would. This converts an existing archive without extracting it.
+// Compressed archives are detected and decompressed transparently.
+//
+// Directories, symlinks, and device nodes are copied with their original headers. Hard links to regular files are
+// written as files that share the target's contents. Other entries are skipped with a warning. Options that select
+// which entries of a tree to archive (e.g. Exclude and GitIgnore) do not apply, and files are never written as sparse
+// entries. As each file's contents can only be read once, files larger than the BufferThreshold are copied into a
+// temporary directory until they are written.
+func (w *Writer) AddTar(r io.Reader) error {
+	return w.AddTarContext(context.Background(), r)
+}
+
+// AddTarContext is like AddTar, but stops promptly if ctx is canceled, in which case it returns ctx.Err() and the
+// archive is incomplete.
+func (w *Writer) AddTarContext(ctx context.Context, r io.Reader) error {
+	if w.rootArchivePath == "" {
+		return errors.New("the archive must have a root path")
+	}
+
+	input, err := openArchive(r)
+	if err != nil {
+		return err
+	}
+
+	w.stream = true
+	defer func() { w.stream = false }()
+
+	return w.walk(ctx, func() error {
+		return w.addTarEntries(tar.NewReader(input))
+	})
+}
+
+// tarFile is a regular file read from a tar archive, which later hard links may refer to.
+type tarFile struct {
+	hash *fileHash
+	size int64
+}
+
+// addTarEntries adds the entries read from archive.
+func (w *Writer) addTarEntries(archive *tar.Reader) error {
+	// The regular files read so far, by their names in the input archive.
+	files := make(map[string]tarFile)
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			// The archive's own global header is written instead.
+			continue
+		}
+
+		inputName := path.Clean(header.Name)
+
+		// Names are confined to the root path, and renamed and stripped as those of any other entry would be.
+		name, ok, err := w.archiveName(path.Join(w.rootArchivePath, path.Clean("/"+header.Name)))
+		if err == nil && !ok {
+			continue
+		}
+		if err == nil {
+			err = checkName(name)
+		}
+		if err == nil {
+			if ok, err = w.checkDuplicate("", name, header.Typeflag == tar.TypeDir); err == nil && !ok {
+				// The directory has already been archived.
+				continue
+			}
+		}
+		if err == nil {
+			err = w.checkCase(name)
+		}
+		if err != nil {
+			if err := w.skip(header.Name, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		stripSparseRecords(header)
+		header.Name, header.Format = name, tar.FormatUnknown
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if w.dirs[name] {
+				continue
+			}
+			w.dirs[name] = true
+
+			header.Name += "/"
+			err = w.emitHeader(header)
+		case tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			err = w.emitHeader(header)
+		case tar.TypeReg, tar.TypeGNUSparse:
+			// GNU sparse entries are expanded by tar.Reader, so they are read as regular entries.
+			header.Typeflag = tar.TypeReg
+			file := tarFile{hash: w.hashTarFile(name, header.Size, archive), size: header.Size}
+			files[inputName] = file
+			err = w.emitTarFile(header, file)
+		case tar.TypeLink:
+			file, ok := files[path.Clean(header.Linkname)]
+			if !ok {
+				w.warn(header.Name, fmt.Errorf("skipping hard link to %s, which is not a regular file", header.Linkname))
+				continue
+			}
+			header.Typeflag, header.Linkname, header.Size = tar.TypeReg, "", file.size
+			err = w.emitTarFile(header, file)
+		default:
+			w.warn(header.Name, fmt.Errorf("skipping entry of unsupported type %q", header.Typeflag))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// hashTarFile hashes the contents of a regular file read from a tar archive, retaining them so that its backing entry
+// can be written once the writing goroutine reaches it.
+func (w *Writer) hashTarFile(name string, size int64, r io.Reader) *fileHash {
+	w.currentPath.Store(name)
+
+	result := &fileHash{done: make(chan struct{})}
+	defer close(result.done)
+
+	if w.options.DryRun && w.options.SkipHashing {
+		// Key the file by its path instead, which is unique within the archive.
+		result.key, result.size = name, size
+	} else {
+		result.err = w.hashContents(r, size, result)
+	}
+	w.filesHashed.Add(1)
+	if result.err == nil {
+		w.log(slog.LevelDebug, "hashed", "path", name, "key", result.key)
+	}
+
+	return result
+}
+
+// emitTarFile queues the entries for a regular file read from a tar archive.
+func (w *Writer) emitTarFile(header *tar.Header, file tarFile) error {
+	fi := header.FileInfo()
+	return w.emit(func() error {
+		if file.size != 0 {
+			return w.writeFile(header.Name, header, fi, file.hash)
+		}
+
+		// Empty files are written as empty regular file entries, as addFile writes them.
+		err := w.writeHeader(header)
+		if err != nil {
+			return fmt.Errorf("%s: %v", header.Name, err)
+		}
+		w.plainFiles++
+		w.log(slog.LevelDebug, "wrote", "path", header.Name, "size", 0)
+		w.indexFile(header.Name, 0)
+		w.added(Entry{Header: header})
+		return nil
+	})
+}
+
+// stripSparseRecords removes the PAX records that describe a sparse entry from header. tar.Reader expands sparse
+// entries, so their contents are read as those of regular entries.
+func stripSparseRecords(header *tar.Header) {
+	for key := range header.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			delete(header.PAXRecords, key)
+		}
+	}
+}
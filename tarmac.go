@@ -1,156 +1,897 @@
-package main
+// Package tarmac implements tar archives with hash-based deduplication.
+//
+// Each unique file content is stored once in the archive under a backing store directory (<root>/.backing_store/<hash>
+// by default), and every file in the archived tree is written as a hard link entry that refers to its backing file. Any
+// tar implementation that supports hard links can extract the result. Empty files are written as empty regular file
+// entries instead, so that they are not extracted as hard links to one another.
+//
+// A file's link entry represents the file at its logical path: it records the file's own mode, times, ownership, and
+// extended attributes, and has no contents. A backing entry records the metadata of the first file that was found
+// with its contents. Extractors should take each file's metadata from its link entry; those that extract link entries
+// as hard links share one inode between a backing file and every file that refers to it, so files with the same
+// contents end up with the same metadata.
+//
+// Each archive begins with a PAX global header whose TARMAC.* records describe how it was written: the format version,
+// the hash algorithm, the compression format, and the path of the backing store.
+package tarmac
 
 import (
 	"archive/tar"
-	"compress/gzip"
-	"crypto/sha512"
-	"encoding/base64"
-	"flag"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type creationContext struct {
+// Options controls how a Writer archives its input.
+type Options struct {
+	// Dereference causes symlinks to be archived as the files they point to rather than as symlinks.
+	Dereference bool
+
+	// FollowInternal causes symlinks whose targets lie within the archived tree to be archived as the entries they
+	// point to. Symlinks that point outside of the tree are archived as symlinks. Dereference takes precedence.
+	FollowInternal bool
+
+	// Hash is the name of the hash algorithm used to derive backing file keys: one of "sha256", "sha512", or
+	// "blake2b". If empty, DefaultHash is used. The algorithm is recorded in the backing store's .algorithm entry.
+	Hash string
+
+	// HashBytes, if non-zero, is the number of bytes to which hashes are truncated before they are encoded as backing
+	// file keys, which shortens the names of backing files. It must be at least MinHashBytes. Truncating hashes
+	// increases the likelihood of collisions between the keys of different contents, and a collision would cause one
+	// file's contents to be replaced by the other's.
+	HashBytes int
+
+	// StoreName is the name of the backing store directory under the archive's root path. If empty, DefaultStoreName
+	// is used. It must be a single path segment. The store's path is recorded in the archive's global header, from
+	// which readers learn where its backing files are; readers also treat every directory named DefaultStoreName as a
+	// backing store, so that name remains reserved within archived trees.
+	StoreName string
+
+	// Exclude is a list of glob patterns (in the syntax of path.Match) that identify entries to omit from the archive.
+	// Patterns that contain a slash are matched against an entry's path relative to the root of its tree; all
+	// other patterns are matched against the entry's name. Excluded directories are not descended into.
+	Exclude []string
+
+	// ExcludeFiles lists the host paths of files to omit wherever they are found while walking a tree, such as the
+	// archive that is being written if it lies within the tree. The final element of each path may be a pattern in the
+	// syntax of filepath.Match. Files are identified by the directory that holds them rather than by their paths, so a
+	// file is omitted even if it is reached through a symlink or a different relative path.
+	ExcludeFiles []string
+
+	// MaxSize and MinSize, if non-zero, are the sizes in bytes of the largest and smallest regular files to archive.
+	// Files outside of these bounds are skipped with a warning. They do not apply to other kinds of entries.
+	MaxSize, MinSize int64
+
+	// NewerThan, if non-zero, causes entries other than directories to be omitted unless they were modified after
+	// NewerThan, which makes an incremental archive of the entries that changed since an earlier one without reading
+	// the others. The bound is exclusive: an entry modified at exactly NewerThan is omitted. Directories are still
+	// walked, and archived, so that the newer entries within them are found.
+	NewerThan time.Time
+
+	// WarnCaseCollisions causes each entry whose path differs only in case from that of an entry that was added
+	// earlier to be reported to Warn, as the two would collide when extracted on a case-insensitive file system.
+	WarnCaseCollisions bool
+
+	// FailCaseCollisions is like WarnCaseCollisions, but treats such entries as errors rather than archiving them.
+	FailCaseCollisions bool
+
+	// GitIgnore causes the rules in any .gitignore files found in the archived tree to be applied to the entries
+	// beneath them, following Git's semantics. The .git directory itself is also omitted.
+	GitIgnore bool
+
+	// IgnoreFile, if non-empty, is the name of a file at the root of each tree whose patterns are added to Exclude
+	// while that tree is added, one per line. Blank lines and lines that begin with # are skipped. The file itself is
+	// not archived. Trees without such a file are unaffected.
+	IgnoreFile string
+
+	// CanonicalModes replaces the permission bits of regular files with 0644, or 0755 if any execute bit is set, and
+	// those of directories with 0755, so that archives do not depend on the umask of whoever created the files. The
+	// setuid, setgid, and sticky bits are kept.
+	CanonicalModes bool
+
+	// StripSetuid clears the setuid and setgid bits of every entry.
+	StripSetuid bool
+
+	// NoAtime causes files and directories to be opened without updating their access times, on platforms that
+	// support it (currently Linux) and where the caller is permitted to do so: the owner of a file, or a process with
+	// CAP_FOWNER. Other files are opened as usual.
+	NoAtime bool
+
+	// Fast reads directories using os.File.ReadDir, which defers the Lstat of each entry until it is known not to be
+	// excluded. This saves a system call for each excluded entry, at the cost of reading an entry's metadata some time
+	// after its directory was listed rather than along with it.
+	Fast bool
+
+	// StreamDirs causes directories to be read and archived a batch of entries at a time rather than listed in full
+	// first, so that memory use does not grow with the size of a directory. Like Fast, it defers the Lstat of each
+	// entry until it is known not to be excluded. It has no effect with Reproducible, which requires full listings in
+	// order to sort them.
+	StreamDirs bool
+
+	// Reproducible causes identical inputs to produce byte-identical archives: directory entries are archived in
+	// sorted order, and timestamps and ownership are cleared from every header.
+	Reproducible bool
+
+	// NoDedup causes regular files to be written as regular file entries at their own paths rather than as links to
+	// backing files, so that the result is a conventional tar archive with no backing store or global header. Hard
+	// links within the tree are written as hard links to the first entry for the file, as other tar implementations
+	// write them. Files are not hashed, and SortedStore has no effect.
+	NoDedup bool
+
+	// LinkToFirst causes regular files to be hashed and deduplicated as usual, but written without a backing store:
+	// the first file with each content is written as a regular file entry at its own path, and each later file with
+	// the same contents as a hard link to that entry. The result is a conventional tar archive with no global header,
+	// like NoDedup's, which any tar implementation extracts with the duplicates hard linked to one another. Chunked,
+	// SortedStore, PackSmall, CompressBacking, and BackingHook have no effect, and it cannot be combined with AddBase
+	// or NewAppendWriter, whose contents are in a backing store.
+	LinkToFirst bool
+
+	// SortedStore causes the entries for the regular files in each tree to be deferred until the tree has been
+	// walked, and then written with the new backing entries first, in order of key, followed by the link entries, in
+	// order of path. The order of the backing store is then independent of the order in which files are discovered.
+	// Directories and other entries are written as they are walked, ahead of the files. Contents are not retained in
+	// memory between hashing and writing a file, so each file is read twice unless SpillDir is set.
+	SortedStore bool
+
+	// Jobs is the number of files that may be hashed concurrently. If zero, runtime.NumCPU() is used. Entries are
+	// always written to the archive in the same order regardless of the number of jobs.
+	Jobs int
+
+	// MaxOpenFiles is the number of files that may be open for reading at once, across the jobs that hash files and
+	// the writes to the archive. Opening another file blocks until one is closed, so that archiving wide trees with
+	// many jobs does not fail with EMFILE. If zero, half of the process's limit on open files is used, or no limit if
+	// it is unknown; if negative, there is no limit. With StreamDirs, the directories that are being walked are held
+	// open as well, one for each level of the tree, and are not counted.
+	MaxOpenFiles int
+
+	// BufferThreshold is the size in bytes of the largest file whose contents are held in memory after it is hashed,
+	// so that its backing entry can be written without reading the file a second time. If zero,
+	// DefaultBufferThreshold is used; if negative, no files are held in memory.
+	BufferThreshold int64
+
+	// SpillDir, if non-empty, is a directory in which to store temporary copies of files larger than BufferThreshold
+	// as they are hashed. Their backing entries are then written from these copies rather than by reading the
+	// original files a second time, which is worthwhile if the source is much slower than SpillDir (e.g. a network
+	// filesystem).
+	//
+	// A file whose size changes after it is listed (e.g. a log file that is being appended to) is archived with the
+	// contents that were hashed, and reported to Warn. A file that is read a second time must still hold at least as
+	// many bytes as were hashed, or the archive cannot be completed; copies in SpillDir are not subject to this.
+	SpillDir string
+
+	// MmapThreshold, if positive, is the size in bytes of the smallest file to map into memory in order to hash it and
+	// write its backing entry, rather than reading it through a buffer, on Linux and macOS. Files that cannot be
+	// mapped, such as those read from an fs.FS or with Retries, are read as usual. A file that is truncated while it is
+	// mapped fails with an error, as it would if it were truncated while it was read.
+	MmapThreshold int64
+
+	// Retries is the number of times to retry opening or reading a file after a transient error (e.g. a network file
+	// system's connection being interrupted), reopening the file and resuming from where the failure occurred. Errors
+	// such as the file not existing or being inaccessible are not retried. Each retry is reported to Warn.
+	Retries int
+
+	// RetryDelay is the time to wait before the first retry of each file, which doubles with each further retry. If
+	// zero, DefaultRetryDelay is used.
+	RetryDelay time.Duration
+
+	// BufferSize is the size in bytes of the buffers used to copy files' contents while hashing and archiving them.
+	// Buffers are reused across files, so memory usage is bounded by Jobs rather than by the number of files. If zero,
+	// DefaultBufferSize is used.
+	BufferSize int
+
+	// Warn, if non-nil, is called for each entry that is skipped rather than archived (e.g. sockets, which cannot be
+	// represented in a tar archive). Calls to Warn are not concurrent.
+	Warn func(archivePath string, err error)
+
+	// Logger, if non-nil, receives a record for each backing file that is written, at the Info level, and for each
+	// file that is hashed or written as a link or regular file entry, at the Debug level. Each warning passed to Warn
+	// is also logged at the Warn level.
+	Logger *slog.Logger
+
+	// Xattrs causes the extended attributes of each entry to be recorded as SCHILY.xattr PAX records, following the
+	// convention used by GNU tar and libarchive. Regular files' attributes are recorded on their link entries.
+	Xattrs bool
+
+	// Flags causes the file flags of each regular file and directory (e.g. immutable, append-only, and nodump) to be
+	// recorded as a SCHILY.fflags PAX record, following the convention used by libarchive. Flags are read using stat(2)
+	// on BSD and macOS and the FS_IOC_GETFLAGS ioctl on Linux, which opens each entry once more. Regular files' flags
+	// are recorded on their link entries.
+	Flags bool
+
+	// HardLinks causes the device and inode numbers of each regular file with more than one hard link to be recorded
+	// on its link entry as SCHILY.dev and SCHILY.ino PAX records, so that an extractor can restore the paths that
+	// shared an inode in the source as hard links to one another (see ExtractOptions.HardLinks). Without the records,
+	// such paths are only linked if their contents are deduplicated into a shared backing file.
+	HardLinks bool
+
+	// Sniff causes the media type of each regular file's contents (e.g. image/png) to be detected using
+	// http.DetectContentType on the first 512 bytes read while hashing them, and recorded as a TARMAC.mimetype PAX
+	// record on the file's entry and on its backing entry, if it has one of its own. The type is reported by List as
+	// Entry.ContentType. Files that are not hashed, such as empty files and those written by NoDedup or SkipHashing,
+	// are not sniffed.
+	Sniff bool
+
+	// Owner and Group, if non-nil, override the owner and group recorded in every header, including those of the
+	// backing files.
+	Owner, Group *Identity
+
+	// UIDMap and GIDMap, if non-nil, replace the user and group IDs recorded in every header with those they map to,
+	// e.g. to move an archive between systems whose accounts are numbered differently. IDs that are not mapped are
+	// recorded as they are, as are user and group names. Owner, Group, and Reproducible take precedence.
+	UIDMap, GIDMap map[int]int
+
+	// DryRun causes the tree to be walked and its files hashed as usual, so that Stats reports the deduplication that
+	// would be performed, without writing anything to the underlying io.Writer.
+	DryRun bool
+
+	// SkipHashing, in combination with DryRun, causes files to be counted without reading them. Each file's contents
+	// are assumed to be unique unless the file is a hard link to another file in the tree.
+	SkipHashing bool
+
+	// OnEntry, if non-nil, is called for each logical entry once it has been written to the archive, in archive order.
+	// Entries are described as List would describe them. Calls to OnEntry are not concurrent.
+	OnEntry func(entry Entry)
+
+	// SkipErrors causes entries that cannot be read (e.g. due to insufficient permissions) to be skipped with a
+	// warning rather than failing the archive. The number of entries skipped is reported by Stats.
+	SkipErrors bool
+
+	// OnError, if non-nil, is called for each entry that cannot be read, and decides whether it is skipped as with
+	// SkipErrors (if OnError returns true) or fails the archive (if it returns false). It takes precedence over
+	// SkipErrors. Calls to OnError are not concurrent.
+	OnError func(archivePath string, err error) bool
+
+	// PAX causes every header to be written in the PAX format, which records modification, access, and change times
+	// with nanosecond resolution rather than truncating them to whole seconds. Extractors that predate PAX ignore the
+	// extended records.
+	PAX bool
+
+	// StripComponents is the number of leading segments to remove from the path of each entry, including the root
+	// path, before it is written to the archive. Entries with no more segments than this are not archived. The backing
+	// store remains under the root path, so the link entries of regular files still refer to their backing files.
+	StripComponents int
+
+	// Renames are rules that rewrite the paths of entries before they are written to the archive, so that its layout
+	// can differ from that of the archived trees (see GlobRename). The first rule that matches an entry's path relative
+	// to the root path is applied, before StripComponents. An entry renamed to the path of another entry fails as a
+	// duplicate, except that directories are merged.
+	Renames []Rename
+
+	// Compression is the name of the compression format that the caller applies to the archive (e.g. "gzip"), if
+	// any. It is only recorded in the archive's global header.
+	Compression string
+
+	// CompressBacking, if non-zero, is the size in bytes of the smallest backing file to store individually
+	// compressed with gzip, so that its contents can be fetched from an uncompressed archive (e.g. with HTTP range
+	// requests) without reading the rest of the stream. Such entries carry TARMAC.encoding and TARMAC.size PAX records
+	// that give their encoding and original size, and are decompressed when a tarmac archive is read; other tar
+	// implementations extract their compressed contents as they are. Sparse files and files that compression does not
+	// make smaller are stored as usual.
+	CompressBacking int64
+
+	// IncompressibleExtensions lists the file name extensions (e.g. ".jpg") of files whose contents are already
+	// compressed. With CompressBacking, the backing files of such files are stored as usual without first trying to
+	// compress them. Extensions are matched without regard to case. DefaultIncompressibleExtensions lists common
+	// compressed formats.
+	IncompressibleExtensions []string
+
+	// Chunked causes non-empty regular files to be split into content-defined chunks, each of which is stored in the
+	// backing store under the key of its own contents, so that files that share most of their contents (e.g.
+	// successive snapshots of a disk image) share most of their chunks. Such a file is written as a regular file entry
+	// whose contents are a chunk manifest that lists the archive paths of its chunks, one per line, and which carries
+	// TARMAC.encoding ("chunks") and TARMAC.size PAX records. Chunked files are reassembled when a tarmac archive is
+	// read; other tar implementations extract their chunks and manifests as they are. Chunked has no effect on the
+	// entries of a tar archive added with AddTar.
+	Chunked bool
+
+	// PackSmall, if non-zero, is the size in bytes below which the unique contents of regular files are packed
+	// together into shared backing files, rather than each being stored in a backing file of its own, which saves the
+	// header and padding of a backing entry for each. A packed file is written as a chunked file (see Chunked) whose
+	// manifest gives the range of the pack that holds its contents. A pack must precede the files that refer to it, so
+	// these files are written once their pack is full or the tree is complete, after the entries that follow them.
+	// PackSmall has no effect with Chunked, SortedStore, or NoDedup.
+	PackSmall int64
+
+	// Blobs, if non-nil, receives the backing store as a separate tar archive, leaving the archive written to the
+	// Writer's io.Writer with only the logical entries, whose links refer to backing files in the Blobs archive. The
+	// logical tree can then be read without fetching the contents of its files. Both archives begin with the same
+	// global header, and can be extracted together by passing the Blobs archive to ExtractAll ahead of the other.
+	Blobs io.Writer
+
+	// Index causes an index of the archive's regular files to be written when the Writer is closed, so that the
+	// contents of a file can be read from an uncompressed archive (e.g. with HTTP range requests) without reading the
+	// rest of it. The index gives the offsets and sizes of the ranges of the archive that hold the contents of each
+	// file, and is written as a JSON entry in the backing store followed by a global header that gives its own
+	// location, at the end of the archive; see ReadIndex. Repair drops the index, whose offsets would not hold in the
+	// repaired archive. Index has no effect with NoDedup, LinkToFirst, or Blobs, in a dry run, or on a Writer created by
+	// NewAppendWriter.
+	Index bool
+
+	// BackingHook, if non-nil, is called with the key, size, and contents of each new backing file (or chunk, with
+	// Chunked) before its entry is written, and the contents of the reader that it returns are stored in its place,
+	// e.g. to encrypt the contents or to replace them with a reference to a copy uploaded elsewhere. The stored
+	// contents may differ in size from the original contents. The hook is called on the writing goroutine, so it must
+	// return before the next entry is written, and is not called in a dry run. Backing files passed to the hook are
+	// never stored sparse or compressed, and tarmac reads their stored contents as they are: an archive whose
+	// contents were transformed cannot be verified or extracted correctly until they are reversed.
+	BackingHook func(key string, size int64, r io.Reader) (io.Reader, error)
+}
+
+// Identity is a user or group recorded in a header.
+type Identity struct {
+	// Name is the user or group name. It may be empty.
+	Name string
+	// ID is the numeric user or group ID.
+	ID int
+}
+
+// DefaultIncompressibleExtensions lists the extensions of common compressed file formats, for use as
+// Options.IncompressibleExtensions.
+var DefaultIncompressibleExtensions = []string{
+	".7z", ".avi", ".br", ".bz2", ".docx", ".flac", ".gif", ".gz", ".heic", ".jar", ".jpeg", ".jpg", ".lz4", ".m4a",
+	".mkv", ".mov", ".mp3", ".mp4", ".ogg", ".png", ".rar", ".tgz", ".txz", ".webm", ".webp", ".xlsx", ".xz",
+	".zip", ".zst",
+}
+
+// DefaultBufferThreshold is the default value of Options.BufferThreshold.
+const DefaultBufferThreshold = 1 << 20
+
+// Version is the version of the tarmac format written by this package. It is recorded in the global header of every
+// archive.
+const Version = "1.0"
+
+// The PAX records of an archive's global header, which describe how the archive was written.
+const (
+	versionRecord     = "TARMAC.version"
+	hashRecord        = "TARMAC.hash"
+	compressionRecord = "TARMAC.compression"
+	storeRecord       = "TARMAC.store"
+)
+
+// DefaultStoreName is the default value of Options.StoreName.
+const DefaultStoreName = ".backing_store"
+
+// DefaultBufferSize is the default value of Options.BufferSize.
+const DefaultBufferSize = 32 << 10
+
+// Stats summarizes the deduplication performed by a Writer.
+type Stats struct {
+	// Files is the number of regular files added to the archive.
+	Files int
+	// UniqueFiles is the number of backing files (or chunks, with Options.Chunked) written to the archive, along with
+	// any files written as regular file entries instead (empty files, or every file with Options.NoDedup).
+	UniqueFiles int
+	// StoredBytes is the total size of the backing files and regular file entries written to the archive.
+	StoredBytes int64
+	// DedupedBytes is the total size of the files (or chunks) whose contents were already present in the backing store.
+	DedupedBytes int64
+	// Skipped is the number of entries that were skipped because they could not be read.
+	Skipped int
+}
+
+// Progress describes the work performed by a Writer so far.
+type Progress struct {
+	// Files is the number of files that have been hashed.
+	Files int64
+	// Bytes is the number of bytes that have been hashed.
+	Bytes int64
+	// Path is the archive path of the file that was most recently queued for hashing.
+	Path string
+}
+
+// backingFile records a unique file content written to the backing store.
+type backingFile struct {
+	size int64
+	refs int
+	// base is set if the contents are stored in a base archive rather than this one. See AddBase.
+	base bool
+	// chunk is set if the contents are a chunk of one or more files rather than the whole of one. See Options.Chunked.
+	chunk bool
+	// pack, if non-nil, is the pack that holds the contents at offset, rather than a backing file of their own. See
+	// Options.PackSmall.
+	pack   *pack
+	offset int64
+	// first, if set, is the archive path of the regular file entry that holds the contents, to which later files with
+	// the same contents are linked. See Options.LinkToFirst.
+	first string
+}
+
+// Writer writes a deduplicated tar archive to an underlying io.Writer.
+type Writer struct {
 	rootArchivePath string
+	output          io.Writer
 	archive         *tar.Writer
-	mapping         map[string]bool
+	blobs           *tar.Writer
+	mapping         map[string]*backingFile
+	dirs            map[string]bool
+	inodes          map[inode]*fileHash
+	links           map[inode]string
+	names           map[string]archivedEntry
+	folded          map[string]string
+	options         Options
+	ignores         ignoreStack
+	treeExcludes    []string
+	treeRoot        string
+	treeArchivePath string
+	visiting        map[inode]bool
+	excludedFiles   []excludedFile
+
+	// fsys, if non-nil, is the file system from which the tree that is being added is read. See AddFS.
+	fsys fs.FS
+
+	// stream is set while the entries of a tar archive are being added, whose contents can only be read once. See
+	// AddTar.
+	stream bool
+
+	// The pipeline that connects the walk to the archive while a tree is being added. See walk.
+	ctx      context.Context
+	queue    chan func() error
+	done     chan struct{}
+	hashers  chan struct{}
+	readers  chan struct{}
+	hashing  sync.WaitGroup
+	spillDir string
+	buffers  sync.Pool
+
+	// pending holds the regular files whose entries are deferred until the end of the walk. See Options.SortedStore.
+	pending []pendingFile
+
+	// Progress counters, which may be read concurrently with the walk.
+	filesHashed atomic.Int64
+	bytesHashed atomic.Int64
+	currentPath atomic.Value
+
+	// stopped is set by Stop, and may also be set concurrently with the walk.
+	stopped atomic.Bool
+
+	warnings sync.Mutex
+	skipped  int
+
+	// The regular files written as regular file entries rather than links, and their total size. See addPlainFile.
+	plainFiles int
+	plainBytes int64
+
+	// The number of regular files written as chunk manifests, and the buffer used to split them into chunks. See
+	// writeChunked.
+	chunkedFiles int
+	chunkBuffer  []byte
+
+	// pack is the pack to which the contents of small files are being added. See Options.PackSmall.
+	pack *pack
+
+	// With Options.Index, the count of bytes written to the archive, the ranges that hold the contents of the backing
+	// entries written so far, by archive path, and the regular files that refer to them. See writeIndex.
+	counter *countingWriter
+	offsets map[string]IndexRange
+	indexed []indexedFile
+
+	wroteGlobalHeader bool
+	wroteAlgorithm    bool
 }
 
-func (ctx *creationContext) addDir(dirPath string, archivePath string, dir *os.File, isRoot bool) error {
-	entries, err := dir.Readdir(0)
+// NewWriter creates a Writer that writes an archive rooted at rootArchivePath to w using the default options.
+func NewWriter(w io.Writer, rootArchivePath string) *Writer {
+	return NewWriterOptions(w, rootArchivePath, Options{})
+}
+
+// NewWriterOptions creates a Writer that writes an archive rooted at rootArchivePath to w using the given options.
+func NewWriterOptions(w io.Writer, rootArchivePath string, options Options) *Writer {
+	bufferSize := options.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+
+	var blobs *tar.Writer
+	if options.Blobs != nil {
+		blobs = tar.NewWriter(options.Blobs)
+	}
+
+	var counter *countingWriter
+	if options.Index && !options.NoDedup && !options.LinkToFirst && options.Blobs == nil && !options.DryRun {
+		counter = &countingWriter{w: w}
+		w = counter
+	}
+
+	return &Writer{
+		rootArchivePath: rootArchivePath,
+		output:          w,
+		archive:         tar.NewWriter(w),
+		blobs:           blobs,
+		counter:         counter,
+		offsets:         make(map[string]IndexRange),
+		mapping:         make(map[string]*backingFile),
+		dirs:            make(map[string]bool),
+		inodes:          make(map[inode]*fileHash),
+		links:           make(map[inode]string),
+		names:           make(map[string]archivedEntry),
+		folded:          make(map[string]string),
+		visiting:        make(map[inode]bool),
+		options:         options,
+		buffers: sync.Pool{New: func() any {
+			b := make([]byte, bufferSize)
+			return &b
+		}},
+	}
+}
+
+// AddTree adds the contents of the directory at dir to the archive under the archive's root path.
+func (w *Writer) AddTree(dir string) error {
+	return w.AddTreeAtContext(context.Background(), dir, "")
+}
+
+// AddTreeContext is like AddTree, but stops promptly if ctx is canceled, in which case it returns ctx.Err() and the
+// archive is incomplete.
+func (w *Writer) AddTreeContext(ctx context.Context, dir string) error {
+	return w.AddTreeAtContext(ctx, dir, "")
+}
+
+// AddTreeAt adds the contents of the directory at dir to the archive under archivePath, which is relative to the
+// archive's root path. The directory itself is always written as the tree's first entry, so an empty directory is
+// still recreated when the archive is extracted. All of the trees added to a Writer share its backing store, so
+// identical files in different trees are stored once. Exclude patterns and .gitignore files apply relative to
+// archivePath.
+func (w *Writer) AddTreeAt(dir string, archivePath string) error {
+	return w.AddTreeAtContext(context.Background(), dir, archivePath)
+}
+
+// AddTreeAtContext is like AddTreeAt, but stops promptly if ctx is canceled, in which case it returns ctx.Err() and
+// the archive is incomplete.
+func (w *Writer) AddTreeAtContext(ctx context.Context, dir string, archivePath string) error {
+	archivePath = path.Join(w.rootArchivePath, archivePath)
+	if archivePath == "" {
+		return errors.New("the archive must have a root path or the tree must be added under a path")
+	}
+
+	f, err := openReadOnly(dir, w.options.NoAtime)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	for _, fi := range entries {
-		if isRoot && fi.Name() == ".backing_store" {
-			continue
-		}
+	// Opening a regular file as a directory succeeds, so check explicitly.
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
 
-		err = ctx.addEntry(filepath.Join(dirPath, fi.Name()), path.Join(archivePath, fi.Name()), fi)
-		if err != nil {
-			return err
-		}
+	err = w.setTreeRoot(dir, archivePath)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return w.walk(ctx, func() error {
+		return w.addDir(dir, archivePath, f, true)
+	})
 }
 
-func (ctx *creationContext) addEntry(entryPath string, archivePath string, fi os.FileInfo) error {
-	f, err := os.OpenFile(entryPath, os.O_RDONLY, 0)
+// AddFiles adds the entries at the given paths, which must lie within the directory at root, to the archive under the
+// archive's root path, along with their parent directories. Unlike AddTree, directories are added without their
+// contents, so that the paths determine exactly which entries are archived.
+func (w *Writer) AddFiles(root string, paths []string) error {
+	return w.AddFilesContext(context.Background(), root, paths)
+}
+
+// AddFilesContext is like AddFiles, but stops promptly if ctx is canceled, in which case it returns ctx.Err() and the
+// archive is incomplete.
+func (w *Writer) AddFilesContext(ctx context.Context, root string, paths []string) error {
+	if w.rootArchivePath == "" {
+		return errors.New("the archive must have a root path")
+	}
+
+	err := w.setTreeRoot(root, w.rootArchivePath)
+	if err != nil {
+		return err
+	}
+
+	return w.walk(ctx, func() error {
+		return w.addFiles(root, paths)
+	})
+}
+
+// setTreeRoot resolves the root of a tree that is being added so that the targets of symlinks can be compared against
+// it, and records the path under which it is archived.
+func (w *Writer) setTreeRoot(dir string, archivePath string) error {
+	w.treeArchivePath = archivePath
+
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	w.treeRoot, err = filepath.EvalSymlinks(root)
 	if err != nil {
 		return err
 	}
 
-	if fi.Mode()&(os.ModeDir|os.ModeSymlink) == os.ModeDir {
-		// Entry is a directory.
-		return ctx.addDir(entryPath, archivePath, f, false)
+	ignorePath := filepath.Join(dir, w.options.IgnoreFile)
+	return w.readTreeExcludes(ignorePath, func() (io.ReadCloser, error) {
+		return os.Open(ignorePath)
+	})
+}
+
+// readTreeExcludes reads the patterns in the Options.IgnoreFile of the tree that is being added, which is at ignorePath
+// and is opened using open, if there is one.
+func (w *Writer) readTreeExcludes(ignorePath string, open func() (io.ReadCloser, error)) error {
+	w.treeExcludes = nil
+	if w.options.IgnoreFile == "" {
+		return nil
 	}
 
-	// Entry is a file. Hash its contents and add a map entry.
-	hash := sha512.New()
-	_, err = io.Copy(hash, f)
+	f, err := open()
 	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
 		return err
 	}
+	defer f.Close()
 
-	hashKey := base64.URLEncoding.EncodeToString(hash.Sum(nil))
-	backingFileArchivePath := path.Join(ctx.rootArchivePath, ".backing_store", hashKey)
+	w.treeExcludes, err = parseExcludeFile(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", ignorePath, err)
+	}
+	return nil
+}
 
-	if _, ok := ctx.mapping[hashKey]; !ok {
-		// The hash was not present in the map. Add a new entry to the archive for the backing file.
-		_, err = f.Seek(0, os.SEEK_SET)
-		if err != nil {
+// Close writes the index, if Options.Index calls for one, and the tar footer, and flushes any buffered data to the
+// underlying io.Writer, and to Options.Blobs if it is set. It does not close the underlying io.Writers.
+func (w *Writer) Close() error {
+	if w.options.DryRun {
+		return nil
+	}
+	if w.indexing() {
+		if err := w.writeIndex(); err != nil {
 			return err
 		}
-
-		header, err := tar.FileInfoHeader(fi, "")
-		if err != nil {
+	}
+	if w.blobs != nil {
+		if err := w.blobs.Close(); err != nil {
 			return err
 		}
+	}
+	return w.archive.Close()
+}
 
-		header.Name = backingFileArchivePath
+// storeName returns the name of the backing store directory. See Options.StoreName.
+func (w *Writer) storeName() string {
+	if w.options.StoreName == "" {
+		return DefaultStoreName
+	}
+	return w.options.StoreName
+}
 
-		err = ctx.archive.WriteHeader(header)
-		if err != nil {
-			return err
+// storePath returns the archive path of the backing store.
+func (w *Writer) storePath() string {
+	return path.Join(w.rootArchivePath, w.storeName())
+}
+
+// target returns the archive to which the entry at name is written, along with its underlying io.Writer: the
+// Options.Blobs archive for backing entries if it is set, or the Writer's own archive otherwise.
+func (w *Writer) target(name string) (*tar.Writer, io.Writer) {
+	if w.blobs != nil && path.Dir(path.Clean(name)) == w.storePath() {
+		return w.blobs, w.options.Blobs
+	}
+	return w.archive, w.output
+}
+
+// Stats returns statistics describing the files added to the archive so far.
+func (w *Writer) Stats() Stats {
+	stats := Stats{Files: w.plainFiles + w.chunkedFiles, UniqueFiles: w.plainFiles, StoredBytes: w.plainBytes}
+	for _, b := range w.mapping {
+		// The references to a chunk are from chunked files, which are counted separately.
+		if !b.chunk {
+			stats.Files += b.refs
 		}
 
-		_, err = io.Copy(ctx.archive, f)
-		if err != nil {
-			return err
+		if b.base {
+			// Every reference to a file in the base archive is deduplicated.
+			stats.DedupedBytes += int64(b.refs) * b.size
+			continue
 		}
 
-		ctx.mapping[hashKey] = true
+		stats.UniqueFiles++
+		stats.StoredBytes += b.size
+		stats.DedupedBytes += int64(b.refs-1) * b.size
 	}
 
-	// Add a hard link entry to the archive from the backing file to the archive path.
-	header, err := tar.FileInfoHeader(fi, "")
-	if err != nil {
-		return err
+	w.warnings.Lock()
+	defer w.warnings.Unlock()
+	stats.Skipped = w.skipped
+
+	return stats
+}
+
+// Progress returns the progress of the writer. It is safe to call Progress concurrently with AddTree or AddFiles.
+func (w *Writer) Progress() Progress {
+	p := Progress{Files: w.filesHashed.Load(), Bytes: w.bytesHashed.Load()}
+	p.Path, _ = w.currentPath.Load().(string)
+	return p
+}
+
+// Stop stops AddTree, AddFiles, or AddTar from adding any further entries, without abandoning the entries that they
+// have already found: those are written in full, and the call then returns ErrStopped, as does any later call. The
+// archive can still be closed, which leaves it a valid archive of the entries that were written. With
+// Options.SortedStore, the entries deferred until the end of the walk are not written. It is safe to call Stop
+// concurrently with the walk.
+func (w *Writer) Stop() {
+	w.stopped.Store(true)
+}
+
+// ErrStopped is returned by the methods that add entries to a Writer once Stop has been called.
+var ErrStopped = errors.New("stopped")
+
+// warn reports a skipped entry.
+func (w *Writer) warn(archivePath string, err error) {
+	w.log(slog.LevelWarn, "warning", "path", archivePath, "error", err)
+
+	if w.options.Warn != nil {
+		w.warnings.Lock()
+		defer w.warnings.Unlock()
+
+		w.options.Warn(archivePath, err)
 	}
+}
 
-	header.Name = archivePath
-	header.Typeflag = tar.TypeLink
-	header.Linkname = backingFileArchivePath
-	header.Size = 0
+// log logs a message at the given level if Options.Logger is set.
+func (w *Writer) log(level slog.Level, msg string, args ...any) {
+	if logger := w.options.Logger; logger != nil {
+		logger.Log(context.Background(), level, msg, args...)
+	}
+}
 
-	return ctx.archive.WriteHeader(header)
+// normalize normalizes the metadata in a header as required by the writer's options.
+func (w *Writer) normalize(header *tar.Header) {
+	if uid, ok := w.options.UIDMap[header.Uid]; ok {
+		header.Uid = uid
+	}
+	if gid, ok := w.options.GIDMap[header.Gid]; ok {
+		header.Gid = gid
+	}
+	if w.options.Reproducible {
+		header.ModTime = time.Unix(0, 0)
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+		header.Uid, header.Gid = 0, 0
+		header.Uname, header.Gname = "", ""
+	}
+	if w.options.CanonicalModes {
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeLink:
+			perm := int64(0644)
+			if header.Mode&0111 != 0 {
+				perm = 0755
+			}
+			header.Mode = header.Mode&^0777 | perm
+		case tar.TypeDir:
+			header.Mode = header.Mode&^0777 | 0755
+		}
+	}
+	if w.options.StripSetuid {
+		header.Mode &^= 06000
+	}
+	if owner := w.options.Owner; owner != nil {
+		header.Uname, header.Uid = owner.Name, owner.ID
+	}
+	if group := w.options.Group; group != nil {
+		header.Gname, header.Gid = group.Name, group.ID
+	}
+	if w.options.PAX {
+		header.Format = tar.FormatPAX
+	}
 }
 
-func main() {
-	flag.Usage = func() {
-		_, program := filepath.Split(os.Args[0])
-		fmt.Fprintf(os.Stderr, "usage: %s [OPTIONS] [FILE]\n", program)
-		flag.PrintDefaults()
+// skip reports an entry that could not be read. If Options.OnError allows it, or Options.SkipErrors is set and there is
+// no OnError, the entry is skipped with a warning and skip returns nil; otherwise, it returns the error, annotated with
+// the entry's path.
+func (w *Writer) skip(archivePath string, err error) error {
+	w.warnings.Lock()
+	skip := w.options.SkipErrors
+	if w.options.OnError != nil {
+		skip = w.options.OnError(archivePath, err)
 	}
+	if skip {
+		w.skipped++
+	}
+	w.warnings.Unlock()
 
-	shouldCompress := flag.Bool("compress", false, "compress output using gzip")
+	if !skip {
+		return fmt.Errorf("%s: %v", archivePath, err)
+	}
+
+	w.warn(archivePath, err)
+	return nil
+}
 
-	flag.Parse()
-	if flag.NArg() != 1 {
-		flag.Usage()
-		os.Exit(2)
+// writeHeader writes a header to the archive, normalizing its metadata as required by the writer's options.
+func (w *Writer) writeHeader(header *tar.Header) error {
+	// Headers are normalized even in a dry run, so that the entries it reports are those that would be written.
+	w.normalize(header)
+	if w.options.DryRun {
+		return nil
 	}
 
-	root, err := filepath.Abs(flag.Arg(0))
+	archive, _ := w.target(header.Name)
+	err := archive.WriteHeader(header)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
-		os.Exit(-1)
+		return err
 	}
+	// tar.Writer writes each header in full, so the entry's contents begin at the current offset.
+	w.recordOffset(header.Name, header.Size, header.PAXRecords[encodingRecord])
+	return nil
+}
 
-	f, err := os.OpenFile(root, os.O_RDONLY, os.ModeDir)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
-		os.Exit(-1)
+// writeGlobalHeader writes a PAX global header describing the archive ahead of its first entry: the format version,
+// the hash algorithm, the compression format, and the path of the backing store.
+func (w *Writer) writeGlobalHeader() error {
+	if w.wroteGlobalHeader || w.options.DryRun || w.options.NoDedup || w.options.LinkToFirst {
+		return nil
 	}
 
-	output := io.WriteCloser(os.Stdout)
-	if *shouldCompress {
-		output = gzip.NewWriter(output)
+	records := map[string]string{
+		versionRecord: Version,
+		hashRecord:    strings.TrimSpace(formatAlgorithm(w.options.Hash, w.options.HashBytes)),
+		storeRecord:   w.storePath(),
+	}
+	if w.options.Compression != "" {
+		records[compressionRecord] = w.options.Compression
 	}
 
-	_, rootArchivePath := filepath.Split(root)
-	ctx := &creationContext{rootArchivePath, tar.NewWriter(output), make(map[string]bool)}
+	for _, archive := range []*tar.Writer{w.archive, w.blobs} {
+		if archive == nil {
+			continue
+		}
+		err := archive.WriteHeader(&tar.Header{
+			Typeflag:   tar.TypeXGlobalHeader,
+			PAXRecords: records,
+			Format:     tar.FormatPAX,
+		})
+		if err != nil {
+			return err
+		}
+	}
 
-	err = ctx.addDir(root, rootArchivePath, f, true)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
-		os.Exit(-1)
+	w.wroteGlobalHeader = true
+	return nil
+}
+
+// writeAlgorithm records the hash algorithm in the backing store ahead of the first backing file.
+func (w *Writer) writeAlgorithm() error {
+	if w.wroteAlgorithm || w.options.DryRun {
+		return nil
 	}
 
-	err = ctx.archive.Close()
+	contents := formatAlgorithm(w.options.Hash, w.options.HashBytes)
+
+	name := path.Join(w.storePath(), algorithmFileName)
+	err := w.writeHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(contents)),
+		ModTime:  time.Now(),
+	})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
-		os.Exit(-1)
+		return fmt.Errorf("%s: %v", name, err)
 	}
 
-	err = output.Close()
+	archive, _ := w.target(name)
+	_, err = io.Copy(archive, strings.NewReader(contents))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
-		os.Exit(-1)
+		return fmt.Errorf("%s: %v", name, err)
 	}
+
+	w.wroteAlgorithm = true
+	return nil
 }
@@ -0,0 +1,216 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTree creates a temporary directory that holds the given files, which are keyed by their slash-separated paths.
+// A path that ends with a slash is created as an empty directory.
+func writeTree(t testing.TB, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, contents := range files {
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(target, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// archiveTree archives the tree at dir under the root path "root" with the given options.
+func archiveTree(t testing.TB, dir string, options Options) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := NewWriterOptions(&buf, "root", options)
+	if err := w.AddTree(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// extractArchive extracts the archive into a temporary directory, which it returns.
+func extractArchive(t testing.TB, archive []byte) string {
+	t.Helper()
+
+	dest := t.TempDir()
+	if err := Extract(bytes.NewReader(archive), dest); err != nil {
+		t.Fatal(err)
+	}
+	return dest
+}
+
+// listNames returns the names of the logical entries of the archive, in archive order.
+func listNames(t testing.TB, archive []byte) []string {
+	t.Helper()
+
+	var names []string
+	err := List(bytes.NewReader(archive), func(entry Entry) error {
+		names = append(names, entry.Header.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+// readTree returns the regular files and directories of the tree at dir, keyed as for writeTree.
+func readTree(t testing.TB, dir string) map[string]string {
+	t.Helper()
+
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(name string, d os.DirEntry, err error) error {
+		if err != nil || name == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			files[rel+"/"] = ""
+			return nil
+		}
+		contents, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		files[rel] = string(contents)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// checkTree fails the test unless the tree at dir holds exactly the given files, keyed as for writeTree.
+func checkTree(t testing.TB, dir string, want map[string]string) {
+	t.Helper()
+
+	got := readTree(t, dir)
+	for name, contents := range want {
+		if actual, ok := got[name]; !ok {
+			t.Errorf("%s is missing", name)
+		} else if actual != contents {
+			t.Errorf("%s: got %q, want %q", name, actual, contents)
+		}
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			t.Errorf("unexpected %s", name)
+		}
+	}
+}
+
+func TestEmptyFilesAreIndependent(t *testing.T) {
+	files := map[string]string{"a": "", "b": "", "c/d": ""}
+	dest := extractArchive(t, archiveTree(t, writeTree(t, files), Options{}))
+	checkTree(t, dest, map[string]string{"root/": "", "root/a": "", "root/b": "", "root/c/": "", "root/c/d": ""})
+
+	var infos []os.FileInfo
+	for name := range files {
+		fi, err := os.Stat(filepath.Join(dest, "root", filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos = append(infos, fi)
+	}
+	for i := range infos {
+		for j := i + 1; j < len(infos); j++ {
+			if os.SameFile(infos[i], infos[j]) {
+				t.Errorf("%s and %s are hard linked", infos[i].Name(), infos[j].Name())
+			}
+		}
+	}
+
+	// Writing to one of the files must leave the others empty.
+	if err := os.WriteFile(filepath.Join(dest, "root", "a"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, dest, map[string]string{"root/": "", "root/a": "changed", "root/b": "", "root/c/": "", "root/c/d": ""})
+}
+
+func TestEmptyAndNonEmptyFiles(t *testing.T) {
+	files := map[string]string{"empty": "", "full": "contents", "dir/empty": "", "dir/full": "contents", "other": "other"}
+	dest := extractArchive(t, archiveTree(t, writeTree(t, files), Options{}))
+
+	want := map[string]string{"root/": "", "root/dir/": ""}
+	for name, contents := range files {
+		want["root/"+name] = contents
+	}
+	checkTree(t, dest, want)
+
+	full, err := os.Stat(filepath.Join(dest, "root", "full"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"empty", "dir/empty"} {
+		fi, err := os.Stat(filepath.Join(dest, "root", filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os.SameFile(fi, full) {
+			t.Errorf("%s is hard linked to full", name)
+		}
+	}
+}
+
+func TestEmptyTree(t *testing.T) {
+	archive := archiveTree(t, writeTree(t, nil), Options{})
+
+	var entries []*tar.Header
+	err := List(bytes.NewReader(archive), func(entry Entry) error {
+		entries = append(entries, entry.Header)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "root/" || entries[0].Typeflag != tar.TypeDir {
+		t.Fatalf("got entries %v, want the root directory alone", entries)
+	}
+
+	// Nor does the archive itself hold any other directory, such as an empty backing store.
+	var dirs int
+	r := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			dirs++
+		}
+	}
+	if dirs != 1 {
+		t.Errorf("got %d directory entries, want 1", dirs)
+	}
+
+	checkTree(t, extractArchive(t, archive), map[string]string{"root/": ""})
+}
@@ -0,0 +1,187 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// VerifyError describes an inconsistency found in an archive by Verify.
+type VerifyError struct {
+	// Path is the archive path of the offending entry.
+	Path string
+	// Err describes the inconsistency.
+	Err error
+}
+
+func (e *VerifyError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+// storeSet is the set of backing stores known to a reader of an archive: those whose paths are recorded by the
+// TARMAC.store records of the archive's global headers, along with any directory named DefaultStoreName, which is
+// where archives without a global header keep their backing files.
+type storeSet map[string]bool
+
+// observe records the backing store named by header if it is a global header. Stores outside of the archive's root,
+// or at the root itself, are ignored.
+func (s storeSet) observe(header *tar.Header) {
+	if header.Typeflag != tar.TypeXGlobalHeader {
+		return
+	}
+	store, ok := header.PAXRecords[storeRecord]
+	if !ok {
+		return
+	}
+
+	store = path.Clean(store)
+	if store == "." || store == ".." || path.IsAbs(store) || strings.HasPrefix(store, "../") {
+		return
+	}
+	s[store] = true
+}
+
+// isStore returns true if dir is the archive path of a backing store.
+func (s storeSet) isStore(dir string) bool {
+	dir = path.Clean(dir)
+	return s[dir] || path.Base(dir) == DefaultStoreName
+}
+
+// contains returns true if the archive path names an entry in a backing store.
+func (s storeSet) contains(archivePath string) bool {
+	return s.isStore(path.Dir(path.Clean(archivePath)))
+}
+
+// Verify reads a tarmac archive from r and checks its integrity: the contents of every backing file must hash to the
+// key encoded in its name, using the algorithm recorded in its backing store, and every hard link entry must refer to
+// an entry that precedes it in the archive. Compressed archives are detected and decompressed transparently.
+//
+// Verify returns the inconsistencies it finds. The returned error is non-nil only if the archive could not be read.
+func Verify(r io.Reader) ([]*VerifyError, error) {
+	input, err := openArchive(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []*VerifyError
+	report := func(archivePath string, err error) {
+		problems = append(problems, &VerifyError{Path: archivePath, Err: err})
+	}
+
+	// The hash algorithms of the backing stores seen so far, as recorded in their .algorithm entries.
+	algorithms := make(map[string]string)
+	entries := make(map[string]bool)
+	// The sizes of the backing files seen so far, against which the chunk manifests of chunked files are checked.
+	sizes := make(map[string]int64)
+	stores := make(storeSet)
+
+	archive := tar.NewReader(input)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return problems, err
+		}
+
+		name := path.Clean(header.Name)
+		switch header.Typeflag {
+		case tar.TypeReg:
+			entries[name] = true
+			if isChunked(header) {
+				if err := verifyManifest(header, archive, sizes, stores); err != nil {
+					report(header.Name, err)
+				}
+				continue
+			}
+			if !stores.contains(name) {
+				continue
+			}
+			sizes[name] = contentSize(header)
+
+			store, key := path.Split(name)
+			store = path.Clean(store)
+			if key == algorithmFileName {
+				contents, err := io.ReadAll(archive)
+				if err != nil {
+					return problems, err
+				}
+				algorithms[store] = string(contents)
+				continue
+			}
+			if key == indexFileName {
+				// The index describes the archive rather than the contents of any file.
+				continue
+			}
+
+			algorithm, bytes, err := parseAlgorithm(algorithms[store])
+			if err == nil {
+				err = checkHash(algorithm, bytes)
+			}
+			if err != nil {
+				report(header.Name, err)
+				continue
+			}
+			hash, _ := newHash(algorithm)
+
+			r, err := contents(header, archive)
+			if err != nil {
+				report(header.Name, err)
+				continue
+			}
+			_, err = io.Copy(hash, r)
+			if err != nil {
+				if r == io.Reader(archive) {
+					return problems, err
+				}
+				// The contents were stored compressed and could not be decompressed.
+				report(header.Name, err)
+				continue
+			}
+
+			if sum := hashKey(hash.Sum(nil), bytes); sum != key {
+				report(header.Name, fmt.Errorf("contents hash to %s", sum))
+			}
+		case tar.TypeLink:
+			if !entries[path.Clean(header.Linkname)] {
+				report(header.Name, fmt.Errorf("dangling link to %s", header.Linkname))
+			}
+		case tar.TypeXGlobalHeader:
+			// Global headers carry no entry, but may name the backing store.
+			stores.observe(header)
+		default:
+			entries[name] = true
+		}
+	}
+
+	return problems, nil
+}
+
+// verifyManifest checks that the chunks listed in the chunk manifest read from r are backing files in stores that
+// precede it in the archive, whose sizes are given by sizes, and that their total size is that recorded in header.
+func verifyManifest(header *tar.Header, r io.Reader, sizes map[string]int64, stores storeSet) error {
+	chunks, err := readManifest(r, stores)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, chunk := range chunks {
+		size, ok := sizes[chunk.path]
+		if !ok {
+			return fmt.Errorf("missing chunk %s", chunk.path)
+		}
+		_, size, ok = chunk.span(size)
+		if !ok {
+			return fmt.Errorf("chunk %s is shorter than the range it spans", chunk.path)
+		}
+		total += size
+	}
+	if size := contentSize(header); total != size {
+		return fmt.Errorf("chunks total %d bytes rather than %d", total, size)
+	}
+	return nil
+}
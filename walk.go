@@ -0,0 +1,1399 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// errStopped is returned to the walk when the writing goroutine has stopped accepting entries.
+var errStopped = errors.New("walk stopped")
+
+// errSizeChanged is returned when a file that is read again after it was hashed is found to be shorter than it was.
+var errSizeChanged = errors.New("file changed size while it was read")
+
+// fileHash is the result of hashing a file in the background. If the file's contents were retained while hashing,
+// either contents or spillPath is set.
+type fileHash struct {
+	key       string
+	size      int64
+	contents  []byte
+	spillPath string
+	err       error
+	done      chan struct{}
+
+	// contentType is the media type detected from the contents if Options.Sniff is set.
+	contentType string
+}
+
+// inode identifies a file independently of the paths that link to it.
+type inode struct {
+	dev, ino uint64
+}
+
+// walk runs walkFunc, which walks a tree of entries, on a separate goroutine and writes the entries it queues to the
+// archive on the calling goroutine. If ctx is canceled, the walk stops before the next entry is written and any files
+// that are being read are abandoned.
+//
+// Hashing the contents of files is the bulk of the work involved in archiving them, so the walk hashes up to
+// Options.Jobs files concurrently and queues a write for each that waits for its hash. The writes are performed in
+// the order in which they were queued, as tar.Writer is not safe for concurrent use. This also means that the
+// backing store mapping is only accessed by the writing goroutine and requires no further synchronization.
+func (w *Writer) walk(ctx context.Context, walkFunc func() error) error {
+	if err := checkHash(w.options.Hash, w.options.HashBytes); err != nil {
+		return err
+	}
+	if name := w.storeName(); name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid backing store name %q", name)
+	}
+	if err := w.writeGlobalHeader(); err != nil {
+		return err
+	}
+
+	jobs := w.options.Jobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	w.ctx = ctx
+	w.queue = make(chan func() error, 4*jobs)
+	w.done = make(chan struct{})
+	w.hashers = make(chan struct{}, jobs)
+
+	w.readers = nil
+	switch maxOpen := w.options.MaxOpenFiles; {
+	case maxOpen > 0:
+		w.readers = make(chan struct{}, maxOpen)
+	case maxOpen == 0 && openFileLimit() > 0:
+		w.readers = make(chan struct{}, max(openFileLimit()/2, 1))
+	}
+
+	// Contents read from a stream must be retained until they are written, so they are always spilled if need be.
+	if w.options.SpillDir != "" || w.stream {
+		spillDir, err := os.MkdirTemp(w.options.SpillDir, "tarmac")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(spillDir)
+
+		w.spillDir = spillDir
+	}
+
+	w.excludedFiles = nil
+	for _, p := range w.options.ExcludeFiles {
+		// A file in a directory that does not exist cannot be walked, so it needs no exclusion.
+		dir, err := os.Stat(filepath.Dir(p))
+		if err == nil {
+			w.excludedFiles = append(w.excludedFiles, excludedFile{dir: dir, pattern: filepath.Base(p)})
+		}
+	}
+
+	w.pending = nil
+	go func() {
+		defer close(w.queue)
+
+		err := walkFunc()
+		if err == nil && w.options.SortedStore {
+			err = w.emit(w.writeSorted)
+		}
+		if err != nil && err != errStopped {
+			w.emit(func() error { return err })
+		}
+	}()
+
+	var err error
+	for write := range w.queue {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		if err = write(); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		// Write the files in the last pack, which is not yet full.
+		err = w.flushPack()
+	}
+
+	// Stop the walk and wait for any outstanding work to finish.
+	close(w.done)
+	for range w.queue {
+	}
+	w.hashing.Wait()
+
+	// Report cancellation rather than any failure that it caused.
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err == nil && w.stopped.Load() {
+		err = ErrStopped
+	}
+	return err
+}
+
+// emit queues a write to be performed by the writing goroutine. It returns errStopped if the writing goroutine has
+// stopped or Stop has been called.
+func (w *Writer) emit(write func() error) error {
+	if w.stopped.Load() {
+		return errStopped
+	}
+
+	select {
+	case w.queue <- write:
+		return nil
+	case <-w.done:
+		return errStopped
+	}
+}
+
+// emitHeader queues the header of a logical entry to be written to the archive.
+func (w *Writer) emitHeader(header *tar.Header) error {
+	return w.emit(func() error {
+		err := w.writeHeader(header)
+		if err != nil {
+			return fmt.Errorf("%s: %v", header.Name, err)
+		}
+
+		w.added(Entry{Header: header})
+		return nil
+	})
+}
+
+// added reports a logical entry that has been written to the archive.
+func (w *Writer) added(entry Entry) {
+	entry.ContentType = entry.Header.PAXRecords[contentTypeRecord]
+	if w.options.OnEntry != nil {
+		w.options.OnEntry(entry)
+	}
+}
+
+// hashFile hashes the contents of the file at entryPath in the background, blocking while Options.Jobs files are
+// already being hashed.
+func (w *Writer) hashFile(entryPath, archivePath string, size int64) *fileHash {
+	result := &fileHash{done: make(chan struct{})}
+	w.currentPath.Store(archivePath)
+
+	w.hashers <- struct{}{}
+	w.hashing.Add(1)
+	go func() {
+		defer func() {
+			close(result.done)
+			<-w.hashers
+			w.hashing.Done()
+		}()
+
+		result.err = w.computeHash(entryPath, size, result)
+		w.filesHashed.Add(1)
+		if result.err == nil {
+			w.log(slog.LevelDebug, "hashed", "path", archivePath, "key", result.key)
+		}
+	}()
+
+	return result
+}
+
+// openContents returns a reader for the contents of the hashed file at entryPath, preferring any copy retained while
+// hashing it.
+func (w *Writer) openContents(entryPath string, hash *fileHash) (io.ReadCloser, error) {
+	switch {
+	case hash.contents != nil:
+		return io.NopCloser(bytes.NewReader(hash.contents)), nil
+	case hash.spillPath != "":
+		return os.Open(hash.spillPath)
+	default:
+		f, err := w.openFile(entryPath)
+		if err != nil {
+			return nil, err
+		}
+
+		// The file may have changed size since it was hashed, but its entries record the size that was hashed.
+		contents := w.mapContents(f)
+		if m, ok := contents.(*mapping); ok {
+			if int64(len(m.data)) < hash.size {
+				m.Close()
+				return nil, errSizeChanged
+			}
+			m.data = m.data[:hash.size]
+			m.Reader = bytes.NewReader(m.data)
+			return m, nil
+		}
+		return &sizedReader{ReadCloser: contents, n: hash.size}, nil
+	}
+}
+
+// sizedReader reads the first n bytes of a file that is read again after it was hashed, ignoring any bytes that were
+// appended to it since and failing if it is now shorter.
+type sizedReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *sizedReader) Read(b []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > r.n {
+		b = b[:r.n]
+	}
+	n, err := r.ReadCloser.Read(b)
+	r.n -= int64(n)
+	if err == io.EOF && r.n > 0 {
+		err = errSizeChanged
+	}
+	return n, err
+}
+
+// resizedFileInfo describes a file whose size changed between being listed and being hashed, reporting the size of the
+// contents that were hashed.
+type resizedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi resizedFileInfo) Size() int64 {
+	return fi.size
+}
+
+// openFile opens the file at entryPath for reading, from the file system that is being added if there is one. If
+// Options.Retries is set, transient errors while opening or reading the file are retried. The file counts against
+// Options.MaxOpenFiles until it is closed.
+func (w *Writer) openFile(entryPath string) (fs.File, error) {
+	w.acquireReader()
+
+	var f fs.File
+	var err error
+	if w.options.Retries > 0 {
+		f, err = w.openRetrying(entryPath)
+	} else {
+		f, err = w.open(entryPath)
+	}
+	if err != nil {
+		w.releaseReader()
+		return nil, err
+	}
+	return &countedFile{File: f, w: w}, nil
+}
+
+// acquireReader blocks until another file may be opened for reading within Options.MaxOpenFiles. Each call must be
+// paired with a call to releaseReader once the file is closed.
+func (w *Writer) acquireReader() {
+	if w.readers != nil {
+		w.readers <- struct{}{}
+	}
+}
+
+func (w *Writer) releaseReader() {
+	if w.readers != nil {
+		<-w.readers
+	}
+}
+
+// countedFile is a file opened by openFile, which releases its place within Options.MaxOpenFiles when it is closed.
+type countedFile struct {
+	fs.File
+	w      *Writer
+	closed bool
+}
+
+func (f *countedFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+
+	err := f.File.Close()
+	f.w.releaseReader()
+	return err
+}
+
+// open opens the file at entryPath for reading, from the file system that is being added if there is one.
+func (w *Writer) open(entryPath string) (fs.File, error) {
+	if w.fsys != nil {
+		return w.fsys.Open(entryPath)
+	}
+	return openReadOnly(entryPath, w.options.NoAtime)
+}
+
+// readLink returns the target of the symlink at entryPath, from the file system that is being added if there is one.
+func (w *Writer) readLink(entryPath string) (string, error) {
+	if w.fsys != nil {
+		return fs.ReadLink(w.fsys, entryPath)
+	}
+	return os.Readlink(entryPath)
+}
+
+// computeHash computes the backing store key for the contents of the file at entryPath. Small files are retained in
+// memory and, if a spill directory is in use, larger files are copied into it while they are hashed, so that their
+// backing entries can be written without reading the original file a second time.
+func (w *Writer) computeHash(entryPath string, size int64, result *fileHash) error {
+	if w.options.DryRun && w.options.SkipHashing {
+		// Key the file by its path instead, which is unique within the tree.
+		result.key = entryPath
+		return nil
+	}
+
+	f, err := w.openFile(entryPath)
+	if err != nil {
+		return err
+	}
+	contents := w.mapContents(f)
+	defer contents.Close()
+
+	return w.hashContents(contents, size, result)
+}
+
+// hashContents computes the backing store key for the size bytes of contents read from r, retaining them in memory or
+// in the spill directory as computeHash describes. If size is negative, the contents are read until EOF, and are
+// spilled rather than retained in memory.
+func (w *Writer) hashContents(r io.Reader, size int64, result *fileHash) error {
+	hash, err := newHash(w.options.Hash)
+	if err != nil {
+		return err
+	}
+
+	threshold := w.options.BufferThreshold
+	if threshold == 0 {
+		threshold = DefaultBufferThreshold
+	}
+
+	dest := io.Writer(hash)
+	switch {
+	case w.options.DryRun:
+		// Nothing is written, so there is no need to retain the file's contents.
+	case size >= 0 && size <= threshold && !(w.stream && w.options.SortedStore):
+		// Contents read from a stream that are not written until the end of the walk are spilled instead, so that
+		// they do not accumulate in memory.
+		buffer := bytes.NewBuffer(make([]byte, 0, size))
+		defer func() { result.contents = buffer.Bytes() }()
+
+		dest = io.MultiWriter(hash, buffer)
+	case w.spillDir != "":
+		spill, err := os.CreateTemp(w.spillDir, "spill")
+		if err != nil {
+			return err
+		}
+		defer spill.Close()
+		result.spillPath = spill.Name()
+
+		dest = io.MultiWriter(hash, spill)
+	}
+
+	var sniff *sniffer
+	if w.options.Sniff {
+		sniff = &sniffer{}
+		dest = io.MultiWriter(dest, sniff)
+	}
+
+	if m, ok := r.(*mapping); ok {
+		result.size, err = w.writeMapped(dest, m.data, &w.bytesHashed)
+	} else {
+		result.size, err = w.copy(dest, &progressReader{r: r, bytes: &w.bytesHashed})
+	}
+	if err != nil {
+		return err
+	}
+	if sniff != nil {
+		result.contentType = contentType(sniff.head)
+	}
+
+	result.key = hashKey(hash.Sum(nil), w.options.HashBytes)
+	return nil
+}
+
+// copy copies src to dst using a buffer from the Writer's pool, or directly if src is mapped into memory (see
+// mapContents). The copy stops if the walk's context is canceled.
+func (w *Writer) copy(dst io.Writer, src io.Reader) (int64, error) {
+	if m, ok := src.(*mapping); ok {
+		return w.writeMapped(dst, m.data, nil)
+	}
+
+	buffer := w.buffers.Get().(*[]byte)
+	defer w.buffers.Put(buffer)
+
+	return io.CopyBuffer(dst, &contextReader{ctx: w.ctx, r: src}, *buffer)
+}
+
+// contextReader fails reads from an underlying reader once a context is canceled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(b)
+}
+
+// progressReader counts the bytes read from an underlying reader.
+type progressReader struct {
+	r     io.Reader
+	bytes *atomic.Int64
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.bytes.Add(int64(n))
+	return n, err
+}
+
+// relPath returns the path of an entry relative to the root of the tree that is being added.
+func (w *Writer) relPath(archivePath string) string {
+	if archivePath == w.treeArchivePath {
+		return ""
+	}
+	return strings.TrimPrefix(archivePath, w.treeArchivePath+"/")
+}
+
+// isExcluded returns true if the entry at the given archive path matches any of the exclude patterns or is ignored by
+// a .gitignore file.
+func (w *Writer) isExcluded(archivePath string, isDir bool) (bool, error) {
+	relPath := w.relPath(archivePath)
+
+	if w.options.IgnoreFile != "" && relPath == w.options.IgnoreFile {
+		return true, nil
+	}
+
+	if w.options.GitIgnore {
+		if isDir && path.Base(archivePath) == ".git" {
+			return true, nil
+		}
+		if w.ignores.ignored(relPath, isDir) {
+			return true, nil
+		}
+	}
+
+	for _, patterns := range [][]string{w.options.Exclude, w.treeExcludes} {
+		for _, pattern := range patterns {
+			name := path.Base(archivePath)
+			if strings.Contains(pattern, "/") {
+				name = relPath
+			}
+
+			matched, err := path.Match(pattern, name)
+			if err != nil {
+				return false, fmt.Errorf("invalid exclude pattern %q: %v", pattern, err)
+			}
+			if matched {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// excludedFile is an entry of Options.ExcludeFiles: the directory that holds the files and the pattern that their names
+// match.
+type excludedFile struct {
+	dir     os.FileInfo
+	pattern string
+}
+
+// excludedNames returns the patterns of Options.ExcludeFiles that apply to the entries of the directory described by
+// fi.
+func (w *Writer) excludedNames(fi os.FileInfo) []string {
+	var patterns []string
+	for _, excluded := range w.excludedFiles {
+		if os.SameFile(excluded.dir, fi) {
+			patterns = append(patterns, excluded.pattern)
+		}
+	}
+	return patterns
+}
+
+// archiveName returns the name under which the entry at archivePath is written to the archive: its path renamed by
+// Options.Renames and then stripped by Options.StripComponents. It returns false if no segments remain.
+func (w *Writer) archiveName(archivePath string) (string, bool, error) {
+	renamed, err := w.renamePath(archivePath)
+	if err != nil {
+		return "", false, err
+	}
+	name, ok := w.stripPath(renamed)
+	return name, ok, nil
+}
+
+// stripPath removes the leading Options.StripComponents segments from archivePath, preserving any trailing slash. It
+// returns false if no segments remain.
+func (w *Writer) stripPath(archivePath string) (string, bool) {
+	n := w.options.StripComponents
+	if n <= 0 {
+		return archivePath, true
+	}
+
+	trimmed := strings.TrimSuffix(archivePath, "/")
+	segments := strings.Split(trimmed, "/")
+	if len(segments) <= n {
+		return "", false
+	}
+	return strings.Join(segments[n:], "/") + archivePath[len(trimmed):], true
+}
+
+// checkName returns an error if name cannot be represented in a tar header. Names that are too long for a USTAR
+// header are stored in PAX records by tar.Writer, but no format can represent a NUL character.
+func checkName(name string) error {
+	if strings.IndexByte(name, 0) != -1 {
+		return fmt.Errorf("name %q contains a NUL character", name)
+	}
+	return nil
+}
+
+// archivedEntry records the source of an entry that has been added to the archive, which is empty for entries that were
+// not read from a file system (see AddReader). See checkDuplicate.
+type archivedEntry struct {
+	entryPath string
+	dir       bool
+}
+
+// checkDuplicate returns false if an entry has already been added at name, in which case the entry at entryPath is not
+// archived again: directories are merged (e.g. when several trees are archived at the same path), and an entry that
+// is added twice is archived once. It returns an error if the name was taken by any other entry (e.g. one whose path
+// was the same once Options.StripComponents was applied), as extractors would let the second overwrite the first.
+func (w *Writer) checkDuplicate(entryPath, name string, isDir bool) (bool, error) {
+	name = path.Clean(name)
+	other, ok := w.names[name]
+	switch {
+	case !ok:
+		w.names[name] = archivedEntry{entryPath: entryPath, dir: isDir}
+		return true, nil
+	case isDir && other.dir, entryPath != "" && entryPath == other.entryPath:
+		return false, nil
+	case other.entryPath == "":
+		return false, errors.New("an entry has already been archived at this path")
+	default:
+		return false, fmt.Errorf("an entry from %s has already been archived at this path", other.entryPath)
+	}
+}
+
+// checkCase reports the entry at name if its path differs only in case from that of an entry that was added earlier.
+// See Options.WarnCaseCollisions and Options.FailCaseCollisions.
+func (w *Writer) checkCase(name string) error {
+	if !w.options.WarnCaseCollisions && !w.options.FailCaseCollisions {
+		return nil
+	}
+
+	name = path.Clean(name)
+	folded := strings.ToLower(name)
+	other, ok := w.folded[folded]
+	if !ok {
+		w.folded[folded] = name
+		return nil
+	}
+	if other == name {
+		return nil
+	}
+
+	err := fmt.Errorf("collides with %s on case-insensitive file systems", other)
+	if w.options.FailCaseCollisions {
+		return err
+	}
+	w.warn(name, err)
+	return nil
+}
+
+// entryHeader returns the header for the entry at entryPath, which will be written to the archive at archivePath (or
+// as it is renamed; see archiveName). It returns a nil header if the entry's path is removed entirely by
+// Options.StripComponents or if the entry has already been archived (see checkDuplicate), in which case the entry is
+// not archived.
+func (w *Writer) entryHeader(entryPath string, archivePath string, fi os.FileInfo, link string) (*tar.Header, error) {
+	name, ok, err := w.archiveName(archivePath)
+	if !ok {
+		return nil, err
+	}
+	for _, name := range []string{name, link} {
+		if err := checkName(name); err != nil {
+			return nil, err
+		}
+	}
+	if ok, err := w.checkDuplicate(entryPath, name, fi.IsDir()); !ok {
+		if stripped, _ := w.stripPath(archivePath); err != nil && stripped != name {
+			err = fmt.Errorf("renamed to %s, but %v", name, err)
+		}
+		return nil, err
+	}
+	if err := w.checkCase(name); err != nil {
+		return nil, err
+	}
+
+	header, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return nil, err
+	}
+
+	header.Name = name
+
+	if w.options.Xattrs && w.fsys == nil {
+		xattrs, err := readXattrs(entryPath)
+		if err != nil {
+			return nil, err
+		}
+		if len(xattrs) != 0 {
+			header.PAXRecords = xattrs
+		}
+	}
+
+	if w.options.Flags && w.fsys == nil && (fi.Mode().IsRegular() || fi.IsDir()) {
+		// The file is opened to read its flags on some platforms, so it counts against Options.MaxOpenFiles.
+		w.acquireReader()
+		flags, err := readFlags(entryPath, w.options.NoAtime)
+		w.releaseReader()
+		if err != nil {
+			return nil, err
+		}
+		if flags != "" {
+			if header.PAXRecords == nil {
+				header.PAXRecords = make(map[string]string)
+			}
+			header.PAXRecords[flagsRecord] = flags
+		}
+	}
+
+	return header, nil
+}
+
+// addDirHeader writes an explicit entry for a directory so that its metadata is preserved even if it is empty, unless
+// one has already been written.
+func (w *Writer) addDirHeader(dirPath string, archivePath string, fi os.FileInfo) error {
+	if w.dirs[archivePath] {
+		return nil
+	}
+
+	header, err := w.entryHeader(dirPath, archivePath+"/", fi, "")
+	if err != nil {
+		return w.skip(archivePath, err)
+	}
+
+	if header != nil {
+		err = w.emitHeader(header)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.dirs[archivePath] = true
+	return nil
+}
+
+// addFiles adds the entries at the given paths, which lie within the directory at root, along with their parent
+// directories. Directories are added without their contents.
+func (w *Writer) addFiles(root string, paths []string) error {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+
+	err = w.addDirHeader(root, w.rootArchivePath, fi)
+	if err != nil {
+		return err
+	}
+
+	if w.options.Reproducible {
+		paths = append([]string(nil), paths...)
+		sort.Strings(paths)
+	}
+
+nextPath:
+	for _, entryPath := range paths {
+		rel, err := filepath.Rel(root, entryPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%s is not within %s", entryPath, root)
+		}
+		if rel == "." {
+			continue
+		}
+
+		segments := strings.Split(filepath.ToSlash(rel), "/")
+		for i, segment := range segments {
+			if segment == DefaultStoreName || (i == 0 && segment == w.storeName()) {
+				return fmt.Errorf("%s: the name %s is reserved for backing stores", entryPath, segment)
+			}
+		}
+
+		// Add the entry's parent directories.
+		dirPath, archivePath, dirInfo := root, w.rootArchivePath, fi
+		for _, segment := range segments[:len(segments)-1] {
+			dirPath, archivePath = filepath.Join(dirPath, segment), path.Join(archivePath, segment)
+
+			fi, err := os.Stat(dirPath)
+			if err != nil {
+				if err = w.skip(archivePath, err); err != nil {
+					return err
+				}
+				continue nextPath
+			}
+
+			err = w.addDirHeader(dirPath, archivePath, fi)
+			if err != nil {
+				return err
+			}
+			dirInfo = fi
+		}
+
+		entryArchivePath := path.Join(archivePath, segments[len(segments)-1])
+
+		fi, err := os.Lstat(entryPath)
+		if err != nil {
+			if err = w.skip(entryArchivePath, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, pattern := range w.excludedNames(dirInfo) {
+			if matched, _ := filepath.Match(pattern, fi.Name()); matched {
+				w.log(slog.LevelDebug, "excluded", "path", entryArchivePath)
+				continue nextPath
+			}
+		}
+
+		excluded, err := w.isExcluded(entryArchivePath, fi.IsDir())
+		if err != nil {
+			return err
+		}
+		if excluded {
+			continue
+		}
+
+		if fi.IsDir() {
+			err = w.addDirHeader(entryPath, entryArchivePath, fi)
+		} else {
+			err = w.addEntry(entryPath, entryArchivePath, fi)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *Writer) addDir(dirPath string, archivePath string, dir *os.File, isRoot bool) error {
+	fi, err := dir.Stat()
+	if err != nil {
+		return w.skip(archivePath, err)
+	}
+
+	// Track the directories that are being walked so that symlinks to them are not followed.
+	if id, _, ok := inodeOf(fi); ok {
+		w.visiting[id] = true
+		defer delete(w.visiting, id)
+	}
+
+	err = w.addDirHeader(dirPath, archivePath, fi)
+	if err != nil {
+		return err
+	}
+
+	if w.options.GitIgnore {
+		ignores, err := readIgnoreFile(filepath.Join(dirPath, ".gitignore"), w.relPath(archivePath))
+		if err != nil {
+			return w.skip(archivePath, err)
+		}
+		if ignores != nil {
+			w.ignores = append(w.ignores, ignores)
+			defer func() { w.ignores = w.ignores[:len(w.ignores)-1] }()
+		}
+	}
+
+	excluded := w.excludedNames(fi)
+	addEntry := func(entryArchivePath string, fi os.FileInfo) error {
+		for _, pattern := range excluded {
+			if matched, _ := filepath.Match(pattern, fi.Name()); matched {
+				w.log(slog.LevelDebug, "excluded", "path", entryArchivePath)
+				return nil
+			}
+		}
+		return w.addEntry(filepath.Join(dirPath, fi.Name()), entryArchivePath, fi)
+	}
+	if w.options.StreamDirs && !w.options.Reproducible {
+		return w.addDirBatches(archivePath, dir, isRoot, addEntry)
+	}
+
+	var entries []fs.DirEntry
+	if w.options.Fast {
+		entries, err = dir.ReadDir(0)
+	} else {
+		var infos []os.FileInfo
+		infos, err = dir.Readdir(0)
+		for _, fi := range infos {
+			entries = append(entries, fs.FileInfoToDirEntry(fi))
+		}
+	}
+	if err != nil {
+		return w.skip(archivePath, err)
+	}
+
+	// The directory is fully listed, so release its descriptor rather than holding one for each level of the tree
+	// while its entries are walked. The caller's deferred Close is then a no-op.
+	dir.Close()
+
+	if w.options.Reproducible {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	}
+
+	return w.addEntries(archivePath, entries, isRoot, addEntry)
+}
+
+// dirBatchSize is the number of entries read at a time from directories with Options.StreamDirs.
+const dirBatchSize = 1024
+
+// addDirBatches adds the entries of the directory dir, which is archived at archivePath, reading dirBatchSize of them
+// at a time. See Options.StreamDirs.
+func (w *Writer) addDirBatches(archivePath string, dir *os.File, isRoot bool,
+	addEntry func(archivePath string, fi os.FileInfo) error) error {
+	for {
+		entries, err := dir.ReadDir(dirBatchSize)
+		if addErr := w.addEntries(archivePath, entries, isRoot, addEntry); addErr != nil {
+			return addErr
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// The rest of the directory cannot be read, so the entries that remain are skipped along with it.
+			return w.skip(archivePath, err)
+		}
+	}
+}
+
+// addEntries adds the entries of the directory archived at archivePath by calling addEntry for each that is not
+// excluded. The FileInfo of an entry is only requested once it is known not to be excluded.
+func (w *Writer) addEntries(archivePath string, entries []fs.DirEntry, isRoot bool,
+	addEntry func(archivePath string, fi os.FileInfo) error) error {
+	for _, entry := range entries {
+		if isRoot && entry.Name() == w.storeName() {
+			continue
+		}
+
+		entryArchivePath := path.Join(archivePath, entry.Name())
+
+		excluded, err := w.isExcluded(entryArchivePath, entry.IsDir())
+		if err != nil {
+			return err
+		}
+		if excluded {
+			continue
+		}
+
+		// Readers of the archive treat the contents of any directory named .backing_store as backing files, so user
+		// content by that name would be misinterpreted.
+		if entry.Name() == DefaultStoreName {
+			return fmt.Errorf("%s: the name %s is reserved for backing stores", entryArchivePath, DefaultStoreName)
+		}
+
+		fi, err := entry.Info()
+		if err != nil {
+			if err = w.skip(entryArchivePath, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = addEntry(entryArchivePath, fi)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *Writer) addSymlink(entryPath string, archivePath string, fi os.FileInfo) error {
+	if !w.isNewer(fi) {
+		return nil
+	}
+
+	target, err := w.readLink(entryPath)
+	if err != nil {
+		return w.skip(archivePath, err)
+	}
+
+	// Link targets are recorded with forward slashes regardless of the host's path separator.
+	header, err := w.entryHeader(entryPath, archivePath, fi, filepath.ToSlash(target))
+	if err != nil {
+		return w.skip(archivePath, err)
+	}
+	if header == nil {
+		return nil
+	}
+
+	return w.emitHeader(header)
+}
+
+func (w *Writer) addSpecial(entryPath string, archivePath string, fi os.FileInfo) error {
+	if !w.isNewer(fi) {
+		return nil
+	}
+
+	header, err := w.entryHeader(entryPath, archivePath, fi, "")
+	if err != nil {
+		return w.skip(archivePath, err)
+	}
+	if header == nil {
+		return nil
+	}
+
+	return w.emitHeader(header)
+}
+
+// shouldFollow returns true if the symlink at entryPath should be archived as the entry it points to, which is
+// described by target.
+func (w *Writer) shouldFollow(entryPath string, target os.FileInfo) (bool, error) {
+	// Never follow a link to a directory that is already being walked, as doing so would never terminate.
+	if id, _, ok := inodeOf(target); ok && target.IsDir() && w.visiting[id] {
+		return false, nil
+	}
+
+	if w.options.Dereference {
+		return true, nil
+	}
+
+	resolved, err := filepath.EvalSymlinks(entryPath)
+	if err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(w.treeRoot, resolved)
+	if err != nil {
+		return false, nil
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+func (w *Writer) addEntry(entryPath string, archivePath string, fi os.FileInfo) error {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if !w.options.Dereference && !w.options.FollowInternal {
+			return w.addSymlink(entryPath, archivePath, fi)
+		}
+
+		target, err := os.Stat(entryPath)
+		if err != nil {
+			if w.options.Dereference || !os.IsNotExist(err) {
+				return w.skip(archivePath, err)
+			}
+			// The link dangles, so there is nothing to follow.
+			return w.addSymlink(entryPath, archivePath, fi)
+		}
+
+		follow, err := w.shouldFollow(entryPath, target)
+		if err != nil {
+			return w.skip(archivePath, err)
+		}
+		if !follow {
+			return w.addSymlink(entryPath, archivePath, fi)
+		}
+
+		// Archive the entry the link points to in place of the link itself.
+		fi = target
+	}
+
+	if fi.IsDir() {
+		// Entry is a directory.
+		f, err := openReadOnly(entryPath, w.options.NoAtime)
+		if err != nil {
+			return w.skip(archivePath, err)
+		}
+		defer f.Close()
+
+		return w.addDir(entryPath, archivePath, f, false)
+	}
+
+	switch {
+	case fi.Mode()&os.ModeSocket != 0:
+		// Sockets cannot be represented in a tar archive.
+		w.warn(archivePath, errors.New("skipping socket"))
+		return nil
+	case fi.Mode()&(os.ModeDevice|os.ModeNamedPipe) != 0:
+		// Entry is a device node or FIFO. These have no contents, and opening them may block, so the header is
+		// all that is written. FileInfoHeader fills in the device numbers.
+		return w.addSpecial(entryPath, archivePath, fi)
+	}
+
+	return w.addFile(entryPath, archivePath, fi)
+}
+
+// isNewer returns false if the entry described by fi is omitted by Options.NewerThan, which happens silently: unlike
+// the entries omitted by MaxSize and MinSize, these are expected to be the majority.
+func (w *Writer) isNewer(fi os.FileInfo) bool {
+	return w.options.NewerThan.IsZero() || fi.ModTime().After(w.options.NewerThan)
+}
+
+// addFile adds a regular file. Its logical metadata is recorded on its link entry.
+func (w *Writer) addFile(entryPath string, archivePath string, fi os.FileInfo) error {
+	switch size := fi.Size(); {
+	case w.options.MaxSize != 0 && size > w.options.MaxSize:
+		w.warn(archivePath, fmt.Errorf("skipping file larger than %d bytes", w.options.MaxSize))
+		return nil
+	case size < w.options.MinSize:
+		w.warn(archivePath, fmt.Errorf("skipping file smaller than %d bytes", w.options.MinSize))
+		return nil
+	case !w.isNewer(fi):
+		return nil
+	}
+
+	header, err := w.entryHeader(entryPath, archivePath, fi, "")
+	if err != nil {
+		return w.skip(archivePath, err)
+	}
+	if header == nil {
+		return nil
+	}
+	if w.options.HardLinks {
+		recordInode(header, fi)
+	}
+
+	// Empty files are not worth deduplicating, and linking them to a shared backing file would leave them hard linked
+	// to one another once extracted.
+	if w.options.NoDedup || fi.Size() == 0 {
+		return w.addPlainFile(entryPath, header, fi)
+	}
+	if w.options.Chunked && !w.options.LinkToFirst && !(w.options.DryRun && w.options.SkipHashing) {
+		return w.addChunkedFile(entryPath, header, fi)
+	}
+
+	// If the file is a hard link to a file that has already been hashed, reuse that file's hash rather than reading it
+	// again.
+	id, links, ok := inodeOf(fi)
+	linked := ok && links > 1
+	hash := w.inodes[id]
+	if !linked || hash == nil {
+		// Hash the file's contents in the background, then write its backing file (if necessary) and its link entry
+		// once the hash is available.
+		hash = w.hashFile(entryPath, archivePath, fi.Size())
+		if linked {
+			w.inodes[id] = hash
+		}
+	}
+
+	return w.emit(func() error {
+		return w.writeFile(entryPath, header, fi, hash)
+	})
+}
+
+// addPlainFile adds a regular file as a regular file entry rather than as a link to a backing file, as is done for
+// empty files and for every file with Options.NoDedup. A hard link to a file that has already been added is written as
+// a hard link to that file's entry.
+func (w *Writer) addPlainFile(entryPath string, header *tar.Header, fi os.FileInfo) error {
+	id, links, ok := inodeOf(fi)
+	linked := ok && links > 1
+
+	// The links are looked up and recorded as the entries are written, so that a file that is skipped is not linked
+	// to.
+	return w.emit(func() error {
+		if linkname, ok := w.links[id]; linked && ok {
+			header.Typeflag, header.Linkname, header.Size = tar.TypeLink, linkname, 0
+			if err := w.writeHeader(header); err != nil {
+				return fmt.Errorf("%s: %v", header.Name, err)
+			}
+			w.added(Entry{Header: header})
+			return nil
+		}
+
+		// Check that the file can be read before writing its header, after which it could no longer be skipped.
+		f, err := w.openFile(entryPath)
+		if err != nil {
+			return w.skip(header.Name, err)
+		}
+		if w.options.NoDedup {
+			// The file may have changed size since it was listed (e.g. a log file that is being appended to), so its
+			// entry records the size it has now. (Empty files are otherwise archived as they were listed.)
+			if current, err := f.Stat(); err == nil && current.Size() != header.Size {
+				w.warn(header.Name, fmt.Errorf("file changed size from %d to %d bytes", header.Size, current.Size()))
+				header.Size = current.Size()
+			}
+		}
+		f.Close()
+
+		if header.Size == 0 {
+			err = w.writeHeader(header)
+		} else {
+			err = w.writeBacking(entryPath, header, &fileHash{size: header.Size})
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", header.Name, err)
+		}
+
+		if linked {
+			w.links[id] = header.Name
+		}
+		w.plainFiles++
+		w.plainBytes += header.Size
+		w.log(slog.LevelDebug, "wrote", "path", header.Name, "size", header.Size)
+		w.indexFile(header.Name, header.Size)
+		w.added(Entry{Header: header})
+		return nil
+	})
+}
+
+// writeBacking writes the backing entry for a regular file. Files whose contents were not retained while hashing them
+// are checked for holes, and sparse files are written as sparse entries so that their holes are not stored. Other
+// files are compressed individually if Options.CompressBacking calls for it.
+func (w *Writer) writeBacking(entryPath string, header *tar.Header, hash *fileHash) error {
+	if w.options.DryRun {
+		return nil
+	}
+
+	// Files written as plain entries (see addPlainFile) have no key, and are not backing files.
+	if w.options.BackingHook != nil && hash.key != "" {
+		contents, err := w.openContents(entryPath, hash)
+		if err != nil {
+			return err
+		}
+		defer contents.Close()
+
+		return w.writeHooked(hash.key, header, contents)
+	}
+
+	// Files read from an fs.FS or a tar stream are not checked for holes, as they are not necessarily backed by the
+	// host's file system.
+	if hash.contents == nil && header.Size > 0 && w.fsys == nil && !w.stream {
+		written, err := w.writeIfSparse(entryPath, header)
+		if err != nil || written {
+			return err
+		}
+	}
+
+	threshold := w.options.CompressBacking
+	if threshold > 0 && header.Size >= threshold && !w.options.LinkToFirst && !w.isIncompressible(entryPath) {
+		written, err := w.writeCompressed(entryPath, header, hash)
+		if err != nil || written {
+			return err
+		}
+	}
+
+	contents, err := w.openContents(entryPath, hash)
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+
+	err = w.writeHeader(header)
+	if err != nil {
+		return err
+	}
+
+	archive, _ := w.target(header.Name)
+	_, err = w.copy(archive, contents)
+	return err
+}
+
+// writeIfSparse writes the backing entry for the regular file at entryPath as a sparse entry if the file has holes. It
+// returns false if the file is not sparse, in which case it has been closed again so that only one file is held open
+// at a time while its backing entry is written.
+func (w *Writer) writeIfSparse(entryPath string, header *tar.Header) (bool, error) {
+	w.acquireReader()
+	defer w.releaseReader()
+
+	f, err := openReadOnly(entryPath, w.options.NoAtime)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	regions, err := sparseRegions(f, header.Size)
+	if err != nil || !isSparse(regions, header.Size) {
+		return false, err
+	}
+	return true, w.writeSparse(f, header, regions)
+}
+
+// writeFile writes the entries for a regular file to the archive, completing header as its link entry. If
+// Options.SortedStore is set, the entries are instead deferred until the walk is complete (see writeSorted), and with
+// Options.PackSmall, small files are packed (see writePacked). It must be called on the writing goroutine.
+func (w *Writer) writeFile(entryPath string, header *tar.Header, fi os.FileInfo, hash *fileHash) error {
+	<-hash.done
+	if hash.err != nil {
+		if hash.spillPath != "" {
+			os.Remove(hash.spillPath)
+		}
+		if err := w.ctx.Err(); err != nil {
+			// The file was abandoned rather than unreadable.
+			return err
+		}
+		return w.skip(header.Name, hash.err)
+	}
+	setContentType(header, hash.contentType)
+
+	if hash.size != fi.Size() && !(w.options.DryRun && w.options.SkipHashing) {
+		// The file changed size between being listed and being hashed (e.g. a log file that is being appended to), so
+		// its entries record the contents that were hashed.
+		w.warn(header.Name, fmt.Errorf("file changed size from %d to %d bytes", fi.Size(), hash.size))
+		fi = resizedFileInfo{FileInfo: fi, size: hash.size}
+		header.Size = hash.size
+	}
+
+	if w.options.SortedStore && !w.options.LinkToFirst {
+		// Contents retained in memory are released rather than held for the rest of the walk, so the backing entry
+		// reads the file again. Copies in the spill directory are kept until the walk is complete.
+		hash.contents = nil
+		w.pending = append(w.pending, pendingFile{entryPath: entryPath, header: header, fi: fi, hash: hash})
+		return nil
+	}
+
+	if hash.spillPath != "" {
+		defer os.Remove(hash.spillPath)
+	}
+
+	if w.options.LinkToFirst {
+		return w.writeLinkToFirst(entryPath, header, fi, hash)
+	}
+	if w.packs(fi.Size()) {
+		return w.writePacked(entryPath, header, fi, hash)
+	}
+
+	err := w.storeContents(entryPath, header, fi, hash)
+	if err != nil {
+		return err
+	}
+	return w.writeLink(header, fi, hash.key)
+}
+
+// pendingFile is a regular file whose entries are deferred by Options.SortedStore.
+type pendingFile struct {
+	entryPath string
+	header    *tar.Header
+	fi        os.FileInfo
+	hash      *fileHash
+}
+
+// writeSorted writes the entries of the regular files that were deferred by Options.SortedStore: first the backing
+// entries for their contents in order of key, then their link entries in order of path.
+func (w *Writer) writeSorted() error {
+	pending := w.pending
+	w.pending = nil
+
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].hash.key < pending[j].hash.key })
+	for _, file := range pending {
+		if err := w.ctx.Err(); err != nil {
+			return err
+		}
+
+		err := w.storeContents(file.entryPath, file.header, file.fi, file.hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].header.Name < pending[j].header.Name })
+	for _, file := range pending {
+		err := w.writeLink(file.header, file.fi, file.hash.key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeContents writes a backing entry for the contents of a regular file, unless they are already in the backing
+// store.
+func (w *Writer) storeContents(entryPath string, header *tar.Header, fi os.FileInfo, hash *fileHash) error {
+	if _, ok := w.mapping[hash.key]; !ok {
+		// The hash was not present in the map. Add a new entry to the archive for the backing file.
+		err := w.writeAlgorithm()
+		if err != nil {
+			return err
+		}
+
+		backingHeader, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+
+		backingHeader.Name = path.Join(w.storePath(), hash.key)
+		setContentType(backingHeader, hash.contentType)
+
+		err = w.writeBacking(entryPath, backingHeader, hash)
+		if err != nil {
+			return fmt.Errorf("%s: %v", header.Name, err)
+		}
+
+		w.mapping[hash.key] = &backingFile{size: fi.Size()}
+		w.log(slog.LevelInfo, "stored", "path", header.Name, "key", hash.key, "size", fi.Size())
+	}
+
+	// Release any retained contents. Other hard links to the same file will find its key in the mapping.
+	hash.contents, hash.spillPath = nil, ""
+	return nil
+}
+
+// writeLink writes header as the link entry for a regular file whose contents are in the backing store under hashKey.
+// The header keeps the file's own metadata, which may differ from that of the backing entry, as the link entry
+// represents the file at its logical path; only the fields that describe its contents are replaced.
+func (w *Writer) writeLink(header *tar.Header, fi os.FileInfo, hashKey string) error {
+	backing := w.mapping[hashKey]
+	backing.refs++
+	deduplicated := backing.refs > 1 || backing.base
+
+	// Add a hard link entry to the archive from the backing file to the archive path.
+	header.Typeflag = tar.TypeLink
+	header.Linkname = path.Join(w.storePath(), hashKey)
+	header.Size = 0
+
+	err := w.writeHeader(header)
+	if err != nil {
+		return fmt.Errorf("%s: %v", header.Name, err)
+	}
+	w.log(slog.LevelDebug, "linked", "path", header.Name, "key", hashKey)
+	w.indexFile(header.Name, fi.Size(), chunkRef{path: header.Linkname, size: -1})
+
+	// Report the file as List would, resolved against its backing file.
+	logical := *header
+	logical.Typeflag, logical.Linkname, logical.Size = tar.TypeReg, "", fi.Size()
+	if w.options.DryRun && w.options.SkipHashing {
+		// The key is not a hash of the file's contents.
+		hashKey = ""
+	}
+	w.added(Entry{Header: &logical, Key: hashKey, Deduplicated: deduplicated})
+	return nil
+}
+
+// writeLinkToFirst writes header as the entry for a regular file with Options.LinkToFirst: as a regular file entry
+// that holds its contents if no earlier file had them, or otherwise as a hard link to the entry of the first file that
+// did.
+func (w *Writer) writeLinkToFirst(entryPath string, header *tar.Header, fi os.FileInfo, hash *fileHash) error {
+	key := hash.key
+	if w.options.DryRun && w.options.SkipHashing {
+		// The key is not a hash of the file's contents.
+		key = ""
+	}
+
+	if b, ok := w.mapping[hash.key]; ok && b.first != "" {
+		b.refs++
+
+		header.Typeflag, header.Linkname, header.Size = tar.TypeLink, b.first, 0
+		if err := w.writeHeader(header); err != nil {
+			return fmt.Errorf("%s: %v", header.Name, err)
+		}
+		w.log(slog.LevelDebug, "linked", "path", header.Name, "target", b.first)
+
+		// Report the file with its contents, as it was found.
+		logical := *header
+		logical.Typeflag, logical.Linkname, logical.Size = tar.TypeReg, "", fi.Size()
+		w.added(Entry{Header: &logical, Key: key, Deduplicated: true})
+		return nil
+	}
+
+	// The entry is not a backing file, so it is written without a key (see writeBacking).
+	err := w.writeBacking(entryPath, header, &fileHash{size: hash.size, contents: hash.contents, spillPath: hash.spillPath})
+	hash.contents, hash.spillPath = nil, ""
+	if err != nil {
+		return fmt.Errorf("%s: %v", header.Name, err)
+	}
+
+	w.mapping[hash.key] = &backingFile{size: fi.Size(), refs: 1, first: header.Name}
+	w.log(slog.LevelInfo, "stored", "path", header.Name, "key", hash.key, "size", fi.Size())
+	w.added(Entry{Header: header, Key: key})
+	return nil
+}
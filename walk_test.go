@@ -0,0 +1,465 @@
+package tarmac
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestAddFilesExcludesOutput(t *testing.T) {
+	dir := writeTree(t, map[string]string{"a": "a", "sub/b": "b"})
+
+	// The archive is written within the tree that it archives, as with find . | tarmac -files-from - ./a.tar.
+	output := filepath.Join(dir, "sub", "out.tar")
+	f, err := os.Create(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := NewWriterOptions(f, "root", Options{ExcludeFiles: []string{output}})
+	paths := []string{filepath.Join(dir, "a"), filepath.Join(dir, "sub"), output, filepath.Join(dir, "sub", "b")}
+	if err = w.AddFiles(dir, paths); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := listNames(t, archive)
+	if slices.Contains(names, "root/sub/out.tar") {
+		t.Errorf("the output was archived: %v", names)
+	}
+	for _, name := range []string{"root/a", "root/sub/", "root/sub/b"} {
+		if !slices.Contains(names, name) {
+			t.Errorf("%s is missing: %v", name, names)
+		}
+	}
+
+	checkTree(t, extractArchive(t, archive), map[string]string{"root/": "", "root/a": "a", "root/sub/": "", "root/sub/b": "b"})
+}
+
+func TestAddTreeExcludesOutput(t *testing.T) {
+	dir := writeTree(t, map[string]string{"a": "a"})
+	output := filepath.Join(dir, "out.tar")
+	if err := os.WriteFile(output, []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := archiveTree(t, dir, Options{ExcludeFiles: []string{output}})
+	if slices.Contains(listNames(t, archive), "root/out.tar") {
+		t.Error("the output was archived")
+	}
+}
+
+// changingFS is a file system whose files change between reads: the nth open of a file listed in versions reads the
+// nth of its versions (or the last, once they run out), while its directory entry reports the size of its contents in
+// the underlying MapFS.
+type changingFS struct {
+	fstest.MapFS
+	versions map[string][]string
+
+	mu    sync.Mutex
+	opens map[string]int
+}
+
+func (fsys *changingFS) Open(name string) (fs.File, error) {
+	versions, ok := fsys.versions[name]
+	if !ok {
+		return fsys.MapFS.Open(name)
+	}
+
+	fsys.mu.Lock()
+	n := min(fsys.opens[name], len(versions)-1)
+	fsys.opens[name]++
+	fsys.mu.Unlock()
+
+	file := *fsys.MapFS[name]
+	file.Data = []byte(versions[n])
+	return fstest.MapFS{name: &file}.Open(name)
+}
+
+// archiveChangingFS archives a file f that is listed with the given contents and then read as each of the versions in
+// turn. The file is read again after it is hashed, as it is larger than the BufferThreshold.
+func archiveChangingFS(t *testing.T, listed string, versions ...string) ([]byte, []error, error) {
+	fsys := &changingFS{
+		MapFS:    fstest.MapFS{"f": &fstest.MapFile{Data: []byte(listed), Mode: 0644}},
+		versions: map[string][]string{"f": versions},
+		opens:    make(map[string]int),
+	}
+
+	var buf bytes.Buffer
+	var warnings []error
+	w := NewWriterOptions(&buf, "root", Options{
+		BufferThreshold: 4,
+		Warn:            func(_ string, err error) { warnings = append(warnings, err) },
+	})
+	err := w.AddFS(fsys)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return buf.Bytes(), warnings, err
+}
+
+func TestFileGrowsBeforeHashing(t *testing.T) {
+	archive, warnings, err := archiveChangingFS(t, "0123456789", "0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("got warnings %v, want one", warnings)
+	}
+
+	problems, err := Verify(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("Verify: %v", problems)
+	}
+
+	err = List(bytes.NewReader(archive), func(entry Entry) error {
+		if entry.Header.Name == "root/f" && entry.Header.Size != 16 {
+			t.Errorf("root/f: got size %d, want 16", entry.Header.Size)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, extractArchive(t, archive), map[string]string{"root/": "", "root/f": "0123456789abcdef"})
+}
+
+func TestFileShrinksAfterHashing(t *testing.T) {
+	_, _, err := archiveChangingFS(t, "0123456789abcdef", "0123456789abcdef", "01234567")
+	// The error is reported along with the file's archive path.
+	if err == nil || !strings.Contains(err.Error(), errSizeChanged.Error()) {
+		t.Fatalf("got error %v, want %v", err, errSizeChanged)
+	}
+}
+
+// archiveStrippedTrees archives each of the trees under its own path with the first segment of each path stripped,
+// so that the contents of the trees are archived at the same paths.
+func archiveStrippedTrees(t *testing.T, options Options, trees ...map[string]string) ([]byte, error) {
+	var buf bytes.Buffer
+	options.StripComponents = 1
+	w := NewWriterOptions(&buf, "", options)
+	for i, files := range trees {
+		if err := w.AddTreeAt(writeTree(t, files), fmt.Sprintf("tree%d", i)); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func TestStripCollision(t *testing.T) {
+	_, err := archiveStrippedTrees(t, Options{}, map[string]string{"x": "one"}, map[string]string{"x": "two"})
+	if err == nil || !strings.Contains(err.Error(), "has already been archived at this path") {
+		t.Fatalf("got error %v, want a collision", err)
+	}
+}
+
+func TestStripCollisionSkipped(t *testing.T) {
+	var warnings []string
+	options := Options{
+		SkipErrors: true,
+		Warn:       func(archivePath string, _ error) { warnings = append(warnings, archivePath) },
+	}
+	archive, err := archiveStrippedTrees(t, options, map[string]string{"x": "one"}, map[string]string{"x": "two", "y": "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(warnings, []string{"tree1/x"}) {
+		t.Errorf("got warnings for %v, want tree1/x", warnings)
+	}
+	checkTree(t, extractArchive(t, archive), map[string]string{"x": "one", "y": "y"})
+}
+
+func TestStripMergesDirectories(t *testing.T) {
+	archive, err := archiveStrippedTrees(t, Options{}, map[string]string{"d/a": "a"}, map[string]string{"d/b": "b", "d/e/": ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dirs int
+	for _, name := range listNames(t, archive) {
+		if name == "d/" {
+			dirs++
+		}
+	}
+	if dirs != 1 {
+		t.Errorf("got %d entries for d/, want 1", dirs)
+	}
+	checkTree(t, extractArchive(t, archive), map[string]string{"d/": "", "d/a": "a", "d/b": "b", "d/e/": ""})
+}
+
+func TestAddTarDuplicate(t *testing.T) {
+	input := rawArchive(t,
+		&tar.Header{Name: "d/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "d/a", Typeflag: tar.TypeReg, Mode: 0644},
+		&tar.Header{Name: "d/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "d/a", Typeflag: tar.TypeReg, Mode: 0644},
+	)
+
+	w := NewWriterOptions(io.Discard, "root", Options{})
+	err := w.AddTar(bytes.NewReader(input))
+	if err == nil || !strings.Contains(err.Error(), "has already been archived at this path") {
+		t.Fatalf("got error %v, want a collision", err)
+	}
+
+	var warnings []string
+	var buf bytes.Buffer
+	w = NewWriterOptions(&buf, "root", Options{
+		SkipErrors: true,
+		Warn:       func(archivePath string, _ error) { warnings = append(warnings, archivePath) },
+	})
+	if err = w.AddTar(bytes.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(warnings, []string{"d/a"}) {
+		t.Errorf("got warnings for %v, want d/a", warnings)
+	}
+	if names := listNames(t, buf.Bytes()); !slices.Equal(names, []string{"root/d/", "root/d/a"}) {
+		t.Errorf("got entries %v", names)
+	}
+}
+
+func TestAppendDuplicate(t *testing.T) {
+	archive := archiveTree(t, writeTree(t, map[string]string{"a": "one"}), Options{})
+	output := filepath.Join(t.TempDir(), "out.tar")
+	if err := os.WriteFile(output, archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(output, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w, err := NewAppendWriter(f, "root", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddTree(writeTree(t, map[string]string{"a": "two", "b": "b"}))
+	if err == nil || !strings.Contains(err.Error(), "has already been archived at this path") {
+		t.Fatalf("got error %v, want a collision", err)
+	}
+}
+
+func TestSkippedHardLinkIsNotLinkedTo(t *testing.T) {
+	dir := writeTree(t, map[string]string{"a": "", "b": ""})
+	if err := os.Link(filepath.Join(dir, "b"), filepath.Join(dir, "c")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove b once the tree has been listed, so that it is skipped when its entry is written.
+	options := Options{
+		Reproducible: true,
+		SkipErrors:   true,
+		Warn:         func(string, error) {},
+		OnEntry: func(entry Entry) {
+			if entry.Header.Name == "root/a" {
+				if err := os.Remove(filepath.Join(dir, "b")); err != nil {
+					t.Error(err)
+				}
+			}
+		},
+	}
+	archive := archiveTree(t, dir, options)
+
+	err := List(bytes.NewReader(archive), func(entry Entry) error {
+		if entry.Header.Name == "root/c" && entry.Header.Typeflag != tar.TypeReg {
+			t.Errorf("root/c: got type %c, want a regular file", entry.Header.Typeflag)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, extractArchive(t, archive), map[string]string{"root/": "", "root/a": "", "root/c": ""})
+}
+
+// rawHeaders returns the headers of the entries of the uncompressed archive, in archive order.
+func rawHeaders(t *testing.T, archive []byte) []*tar.Header {
+	t.Helper()
+
+	var headers []*tar.Header
+	r := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return headers
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, header)
+	}
+}
+
+func TestDedupedPairHeaders(t *testing.T) {
+	type metadata struct {
+		mode         int64
+		mtime        time.Time
+		uid, gid     int
+		uname, gname string
+	}
+	dir := writeTree(t, map[string]string{"a": "contents", "b": "contents"})
+	want := map[string]metadata{
+		"root/a": {mode: 0600, mtime: time.Unix(1000000000, 0), uid: 0, gid: 0},
+		"root/b": {mode: 0755, mtime: time.Unix(1200000000, 0), uid: 1, gid: 2},
+	}
+	for name, m := range want {
+		target := filepath.Join(dir, path.Base(name))
+		if err := os.Chmod(target, os.FileMode(m.mode)); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(target, m.mtime, m.mtime); err != nil {
+			t.Fatal(err)
+		}
+		if os.Geteuid() == 0 {
+			if err := os.Lchown(target, m.uid, m.gid); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fi, err := os.Lstat(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.uid, m.gid, m.uname, m.gname = header.Uid, header.Gid, header.Uname, header.Gname
+		want[name] = m
+	}
+
+	check := func(header *tar.Header, m metadata) {
+		t.Helper()
+		got := metadata{header.Mode & 07777, header.ModTime, header.Uid, header.Gid, header.Uname, header.Gname}
+		if got.mode != m.mode || !got.mtime.Equal(m.mtime) || got.uid != m.uid || got.gid != m.gid ||
+			got.uname != m.uname || got.gname != m.gname {
+			t.Errorf("%s: got %+v, want %+v", header.Name, got, m)
+		}
+	}
+
+	headers := make(map[string]*tar.Header)
+	var first string
+	for _, header := range rawHeaders(t, archiveTree(t, dir, Options{})) {
+		headers[header.Name] = header
+		if _, ok := want[header.Name]; ok && first == "" {
+			first = header.Name
+		}
+	}
+
+	// Each link entry records the metadata of its own file, and has no contents.
+	var linkname string
+	for name, m := range want {
+		link, ok := headers[name]
+		if !ok {
+			t.Fatalf("%s is missing", name)
+		}
+		if link.Typeflag != tar.TypeLink || link.Size != 0 {
+			t.Errorf("%s: got type %c and size %d, want an empty link entry", name, link.Typeflag, link.Size)
+		}
+		check(link, m)
+		if linkname != "" && link.Linkname != linkname {
+			t.Errorf("%s links to %s, want %s", name, link.Linkname, linkname)
+		}
+		linkname = link.Linkname
+	}
+
+	// The backing entry records the metadata of the first file that was found with its contents.
+	backing, ok := headers[linkname]
+	if !ok {
+		t.Fatalf("the backing entry %s is missing", linkname)
+	}
+	if backing.Typeflag != tar.TypeReg || backing.Size != int64(len("contents")) {
+		t.Errorf("%s: got type %c and size %d, want a regular file with the contents", linkname, backing.Typeflag, backing.Size)
+	}
+	check(backing, want[first])
+}
+
+func TestNewerThan(t *testing.T) {
+	threshold := time.Unix(1000000000, 0)
+	tests := []struct {
+		name     string
+		mtime    time.Time
+		archived bool
+	}{
+		{"older", threshold.Add(-time.Second), false},
+		{"equal", threshold, false},
+		{"newer", threshold.Add(time.Second), true},
+	}
+
+	dir := writeTree(t, map[string]string{"older": "older", "equal": "equal", "newer": "newer"})
+	for _, test := range tests {
+		if err := os.Chtimes(filepath.Join(dir, test.name), test.mtime, test.mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := listNames(t, archiveTree(t, dir, Options{NewerThan: threshold}))
+	for _, test := range tests {
+		if archived := slices.Contains(names, "root/"+test.name); archived != test.archived {
+			t.Errorf("%s: archived is %v, want %v", test.name, archived, test.archived)
+		}
+	}
+	if !slices.Contains(names, "root/") {
+		t.Error("the root directory is missing")
+	}
+}
+
+func TestHeaderErrorNamesEntryOnce(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+	}{
+		{"plain", Options{NoDedup: true}},
+		{"link to first", Options{LinkToFirst: true}},
+	}
+
+	dir := writeTree(t, map[string]string{"f": "contents"})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// No tar format can encode an owner name that contains a NUL character, so every header fails to be
+			// written. The root directory is stripped, so that the first header to fail is that of the file.
+			options := test.options
+			options.Owner = &Identity{Name: "a\x00b"}
+			options.StripComponents = 1
+
+			w := NewWriterOptions(io.Discard, "root", options)
+			err := w.AddFiles(dir, []string{filepath.Join(dir, "f")})
+			if err == nil {
+				err = w.Close()
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if msg := err.Error(); !strings.HasPrefix(msg, "f: ") || strings.HasPrefix(msg, "f: f: ") {
+				t.Errorf("got %q, want an error that names f once", msg)
+			}
+		})
+	}
+}
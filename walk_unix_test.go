@@ -0,0 +1,38 @@
+//go:build unix
+
+package tarmac
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestDeepTreeReleasesDirectories(t *testing.T) {
+	const depth = 64
+	dir := writeTree(t, map[string]string{strings.Repeat("d/", depth) + "f": "f"})
+
+	// Archive the tree with far fewer descriptors than it has levels, so that holding a descriptor for each directory
+	// that is being walked exhausts them.
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	low := limit
+	low.Cur = 32
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &low); err != nil {
+		t.Skip(err)
+	}
+	archive := func() []byte {
+		defer syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)
+		return archiveTree(t, dir, Options{Jobs: 1})
+	}()
+
+	want := "root/" + strings.Repeat("d/", depth) + "f"
+	for _, name := range listNames(t, archive) {
+		if name == want {
+			return
+		}
+	}
+	t.Errorf("%s is missing", want)
+}
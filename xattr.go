@@ -0,0 +1,4 @@
+package tarmac
+
+// xattrPrefix is the prefix of the PAX records that hold extended attributes.
+const xattrPrefix = "SCHILY.xattr."
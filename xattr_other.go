@@ -0,0 +1,25 @@
+//go:build !linux && !darwin
+
+package tarmac
+
+import (
+	"errors"
+	"strings"
+)
+
+// readXattrs returns the extended attributes of the file at path as SCHILY.xattr PAX records. Extended attributes
+// are not supported on this platform.
+func readXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+// writeXattrs sets the extended attributes in the given PAX records on the file at path. Extended attributes are not
+// supported on this platform.
+func writeXattrs(path string, records map[string]string) error {
+	for key := range records {
+		if strings.HasPrefix(key, xattrPrefix) {
+			return errors.New("extended attributes are not supported on this platform")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+//go:build linux || darwin
+
+package tarmac
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of the file at path as SCHILY.xattr PAX records. Symlinks are not
+// followed.
+func readXattrs(path string) (map[string]string, error) {
+	names, err := xattrList(path)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+
+	records := make(map[string]string)
+	for _, name := range names {
+		value, err := xattrGet(path, name)
+		if err != nil {
+			return nil, err
+		}
+		records[xattrPrefix+name] = string(value)
+	}
+	return records, nil
+}
+
+// writeXattrs sets the extended attributes in the given PAX records on the file at path. Symlinks are not followed.
+func writeXattrs(path string, records map[string]string) error {
+	for key, value := range records {
+		if strings.HasPrefix(key, xattrPrefix) {
+			err := unix.Lsetxattr(path, key[len(xattrPrefix):], []byte(value), 0)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func xattrList(path string) ([]string, error) {
+	for {
+		size, err := unix.Llistxattr(path, nil)
+		if err != nil {
+			if err == unix.ENOTSUP {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, size)
+		size, err = unix.Llistxattr(path, buf)
+		if err == unix.ERANGE {
+			// The list grew between calls.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return strings.Split(strings.TrimSuffix(string(buf[:size]), "\x00"), "\x00"), nil
+	}
+}
+
+func xattrGet(path, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size)
+		size, err = unix.Lgetxattr(path, name, buf)
+		if err == unix.ERANGE {
+			// The value grew between calls.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return buf[:size], nil
+	}
+}